@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drio/spanza/gateway"
+	"github.com/drio/spanza/tunnel"
+	"github.com/drio/spanza/wgbind"
+)
+
+// Benchmark: direct WireGuard vs WireGuard relayed through DERP
+//
+// Both pairs run in this process on userspace networking (like userspace/ustest.go):
+//   - direct:  peer2 → UDP (loopback) → peer1
+//   - relayed: peer2 → UDP → Spanza gateway → DERP → Spanza gateway → UDP → peer1
+//
+// peer1 serves HTTP, peer2 measures request latency and download throughput.
+
+const (
+	// IP addresses (each pair has its own netstack, so they can be reused)
+	peer1IP = "192.168.4.1"
+	peer2IP = "192.168.4.2"
+	dnsIP   = "8.8.8.8"
+
+	// Ports for the direct pair
+	directPeer1WGPort = 51830
+	directPeer2WGPort = 51831
+
+	// Ports for the relayed pair
+	relayPeer1WGPort      = 51840
+	relayPeer1GatewayPort = 51841
+	relayPeer2WGPort      = 51842
+	relayPeer2GatewayPort = 51843
+
+	// DERP keys (same as userspace/)
+	peer1DERPPrivate = "privkey:a85c6983dd4e96c1e54aed78a21b3e50f26bd2786cbddfb6d01cdd77673bda7d"
+	peer1DERPPublic  = "nodekey:4b115ea75d1aeb08d489d9b9015f4b8228a60e1cfe4e231332e29bc4da71f659"
+	peer2DERPPrivate = "privkey:503685023b6d449ea3ade66f9348778666bf2fae863580e86124e7388b4bc37c"
+	peer2DERPPublic  = "nodekey:e3603e7b1d8024bad24da4c413b5989211c4f8e5ead29660f05addaa454e810b"
+
+	// WireGuard keys (same as container setup)
+	peer1WGPrivate = "087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379"
+	peer1WGPublic  = "f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c"
+	peer2WGPrivate = "003ed5d73b55806c30de3f8a7bdab38af13539220533055e635690b8b87ad641"
+	peer2WGPublic  = "c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28"
+)
+
+var (
+	derpURL   = flag.String("derp-url", "https://derp.tailscale.com/derp", "DERP server URL for the relayed pair")
+	sizeKB    = flag.Int("size", 1024, "Download size in KB for the throughput test")
+	pings     = flag.Int("pings", 10, "Number of requests for the latency test")
+	skipRelay = flag.Bool("direct-only", false, "Only benchmark the direct pair")
+)
+
+// result holds the measurements for one transport
+type result struct {
+	name       string
+	latency    time.Duration // Average request round trip
+	throughput float64       // Download throughput in KB/s
+	bytes      int64         // Downloaded in the throughput test
+}
+
+func main() {
+	flag.Parse()
+
+	log.Println("Starting spanza benchmark (direct vs relayed)...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var results []result
+
+	direct, err := benchDirect(ctx)
+	if err != nil {
+		log.Fatalf("[direct] Benchmark failed: %v", err)
+	}
+	results = append(results, direct)
+
+	if !*skipRelay {
+		relayed, err := benchRelayed(ctx, nil, nil)
+		if err != nil {
+			log.Fatalf("[relayed] Benchmark failed: %v", err)
+		}
+		results = append(results, relayed)
+	}
+
+	printResults(results)
+}
+
+// benchDirect stands up two peers that talk WireGuard straight to each other
+func benchDirect(ctx context.Context) (result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Println("[direct] Starting peers...")
+
+	mtu := wgbind.RecommendedMTU(wgbind.TransportUDP)
+	peer1, err := startServerPeer(ctx, "[direct-peer1]", mtu, directPeer1WGPort, directPeer2WGPort)
+	if err != nil {
+		return result{}, err
+	}
+	defer peer1.Close()
+
+	peer2, err := startClientPeer("[direct-peer2]", mtu, directPeer2WGPort, directPeer1WGPort)
+	if err != nil {
+		return result{}, err
+	}
+	defer peer2.Close()
+
+	return measure("direct", peer2)
+}
+
+// benchRelayed stands up two peers whose WireGuard traffic goes through DERP.
+// derp1 and derp2 are the gateways' DERP clients; nil connects them to
+// --derp-url.
+func benchRelayed(ctx context.Context, derp1, derp2 gateway.DERPClient) (result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Println("[relayed] Starting Spanza gateways...")
+
+	peer1UDPConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: relayPeer1GatewayPort})
+	if err != nil {
+		return result{}, err
+	}
+	defer peer1UDPConn.Close()
+
+	peer2UDPConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: relayPeer2GatewayPort})
+	if err != nil {
+		return result{}, err
+	}
+	defer peer2UDPConn.Close()
+
+	go func() {
+		cfg := gateway.Config{
+			Prefix:          "[peer1-gw]",
+			DerpURL:         *derpURL,
+			PrivKeyStr:      peer1DERPPrivate,
+			RemotePubKeyStr: peer2DERPPublic,
+			DerpClient:      derp1,
+			WGEndpoint:      fmt.Sprintf("127.0.0.1:%d", relayPeer1WGPort),
+		}
+		if err := gateway.Run(ctx, cfg, peer1UDPConn); err != nil {
+			log.Printf("[peer1-gw] Error: %v", err)
+		}
+	}()
+
+	go func() {
+		cfg := gateway.Config{
+			Prefix:          "[peer2-gw]",
+			DerpURL:         *derpURL,
+			PrivKeyStr:      peer2DERPPrivate,
+			RemotePubKeyStr: peer1DERPPublic,
+			DerpClient:      derp2,
+			WGEndpoint:      fmt.Sprintf("127.0.0.1:%d", relayPeer2WGPort),
+		}
+		if err := gateway.Run(ctx, cfg, peer2UDPConn); err != nil {
+			log.Printf("[peer2-gw] Error: %v", err)
+		}
+	}()
+
+	// Give gateways a moment to connect to DERP
+	time.Sleep(1 * time.Second)
+
+	log.Println("[relayed] Starting peers...")
+
+	// The peers only speak UDP to their gateways, but every packet crosses
+	// DERP, so size it for DERP rather than for the UDP hop
+	mtu := wgbind.RecommendedMTU(wgbind.TransportDERP)
+	peer1, err := startServerPeer(ctx, "[relayed-peer1]", mtu, relayPeer1WGPort, relayPeer1GatewayPort)
+	if err != nil {
+		return result{}, err
+	}
+	defer peer1.Close()
+
+	peer2, err := startClientPeer("[relayed-peer2]", mtu, relayPeer2WGPort, relayPeer2GatewayPort)
+	if err != nil {
+		return result{}, err
+	}
+	defer peer2.Close()
+
+	return measure("relayed", peer2)
+}
+
+// startServerPeer creates peer1 with an HTTP server on its tunnel address.
+// mtu should suit the transport under test (see wgbind.RecommendedMTU).
+// endpointPort is where its WireGuard packets go (the other peer or a gateway).
+func startServerPeer(ctx context.Context, prefix string, mtu, wgPort, endpointPort int) (*tunnel.Tunnel, error) {
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    peer1IP,
+		DNS:        dnsIP,
+		MTU:        mtu,
+		PrivateKey: peer1WGPrivate,
+		ListenPort: wgPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey:           peer2WGPublic,
+			Endpoint:            fmt.Sprintf("127.0.0.1:%d", endpointPort),
+			AllowedIPs:          []string{peer2IP + "/32"},
+			PersistentKeepalive: 25,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tun.ListenTCP(80)
+	if err != nil {
+		tun.Close()
+		return nil, err
+	}
+
+	// /ping answers immediately, /data?kb=N streams N KB of zeros
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		kb, err := strconv.Atoi(r.URL.Query().Get("kb"))
+		if err != nil || kb <= 0 {
+			http.Error(w, "invalid kb", http.StatusBadRequest)
+			return
+		}
+		chunk := make([]byte, 1024)
+		for i := 0; i < kb; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+		listener.Close()
+	}()
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("%s Server error: %v", prefix, err)
+		}
+	}()
+
+	log.Printf("%s Ready on %s:80", prefix, peer1IP)
+	return tun, nil
+}
+
+// startClientPeer creates peer2, the side that runs the measurements.
+func startClientPeer(prefix string, mtu, wgPort, endpointPort int) (*tunnel.Tunnel, error) {
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    peer2IP,
+		DNS:        dnsIP,
+		MTU:        mtu,
+		PrivateKey: peer2WGPrivate,
+		ListenPort: wgPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey: peer1WGPublic,
+			Endpoint:  fmt.Sprintf("127.0.0.1:%d", endpointPort),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%s WireGuard interface up (MTU %d)", prefix, mtu)
+	return tun, nil
+}
+
+// measure runs the latency and throughput tests from peer2 to peer1
+func measure(name string, peer2 *tunnel.Tunnel) (result, error) {
+	client := peer2.HTTPClient()
+	client.Timeout = 60 * time.Second
+	baseURL := fmt.Sprintf("http://%s", net.JoinHostPort(peer1IP, "80"))
+
+	// The first request also pays for the handshake, keep it out of the numbers
+	log.Printf("[%s] Warming up (handshake)...", name)
+	if _, err := get(client, baseURL+"/ping"); err != nil {
+		return result{}, fmt.Errorf("warm up: %w", err)
+	}
+
+	log.Printf("[%s] Measuring latency (%d requests)...", name, *pings)
+	start := time.Now()
+	for i := 0; i < *pings; i++ {
+		if _, err := get(client, baseURL+"/ping"); err != nil {
+			return result{}, fmt.Errorf("latency: %w", err)
+		}
+	}
+	latency := time.Since(start) / time.Duration(*pings)
+
+	log.Printf("[%s] Measuring throughput (%d KB)...", name, *sizeKB)
+	start = time.Now()
+	n, err := get(client, fmt.Sprintf("%s/data?kb=%d", baseURL, *sizeKB))
+	if err != nil {
+		return result{}, fmt.Errorf("throughput: %w", err)
+	}
+	throughput := float64(*sizeKB) / time.Since(start).Seconds()
+
+	return result{name: name, latency: latency, throughput: throughput, bytes: n}, nil
+}
+
+// get performs a GET request and drains the body, returning its size
+func get(client *http.Client, url string) (int64, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return io.Copy(io.Discard, resp.Body)
+}
+
+// printResults prints a comparison table of the measured transports
+func printResults(results []result) {
+	log.Println("")
+	log.Println("─────────────────────────────────────────")
+	log.Printf("%-10s %14s %16s", "transport", "latency", "throughput")
+	for _, r := range results {
+		log.Printf("%-10s %14s %11.1f KB/s", r.name, r.latency.Round(time.Microsecond), r.throughput)
+	}
+	if len(results) == 2 && results[1].throughput > 0 {
+		log.Printf("relay cost: %.1fx latency, %.1fx slower throughput",
+			float64(results[1].latency)/float64(results[0].latency),
+			results[0].throughput/results[1].throughput)
+	}
+	log.Println("─────────────────────────────────────────")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drio/spanza/gateway"
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/wgbind"
+	"tailscale.com/types/key"
+)
+
+// setBenchSize makes the benchmark small enough for a test.
+func setBenchSize(t *testing.T) {
+	*sizeKB, *pings = 1024, 10
+	if testing.Short() {
+		*sizeKB, *pings = 64, 2
+	}
+}
+
+// checkResult checks that r is a complete measurement of transport name.
+func checkResult(t *testing.T, r result, name string) {
+	t.Helper()
+	if r.name != name {
+		t.Errorf("name = %q, want %q", r.name, name)
+	}
+	if r.latency <= 0 {
+		t.Errorf("latency = %v, want > 0", r.latency)
+	}
+	if r.throughput <= 0 {
+		t.Errorf("throughput = %v KB/s, want > 0", r.throughput)
+	}
+	if want := int64(*sizeKB) * 1024; r.bytes != want {
+		t.Errorf("downloaded %d bytes, want %d", r.bytes, want)
+	}
+}
+
+// TestBenchDirect runs the direct pair end to end: two in-process peers over
+// loopback UDP.
+func TestBenchDirect(t *testing.T) {
+	setBenchSize(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	r, err := benchDirect(ctx)
+	if err != nil {
+		t.Fatalf("benchDirect: %v", err)
+	}
+	checkResult(t, r, "direct")
+}
+
+// countingDERP counts the bytes a gateway sends through DERP.
+type countingDERP struct {
+	gateway.DERPClient
+	sent atomic.Int64
+}
+
+func (c *countingDERP) Send(dstKey key.NodePublic, b []byte) error {
+	c.sent.Add(int64(len(b)))
+	return c.DERPClient.Send(dstKey, b)
+}
+
+// TestBenchRelayed runs the relayed pair with the gateways on an in-memory
+// DERP connection instead of a DERP server.
+func TestBenchRelayed(t *testing.T) {
+	setBenchSize(t)
+
+	peer1, err := keys.ParseNodePublic(peer1DERPPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2, err := keys.ParseNodePublic(peer2DERPPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn1, conn2 := wgbind.NewMemDERPPair(peer1, peer2)
+	derp1 := &countingDERP{DERPClient: conn1}
+	derp2 := &countingDERP{DERPClient: conn2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	r, err := benchRelayed(ctx, derp1, derp2)
+	if err != nil {
+		t.Fatalf("benchRelayed: %v", err)
+	}
+	checkResult(t, r, "relayed")
+
+	// The download really crossed DERP, and so did the requests
+	if sent := derp1.sent.Load(); sent < r.bytes {
+		t.Errorf("peer1's gateway sent %d bytes through DERP, less than the %d downloaded", sent, r.bytes)
+	}
+	if sent := derp2.sent.Load(); sent == 0 {
+		t.Error("peer2's gateway sent nothing through DERP")
+	}
+}
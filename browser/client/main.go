@@ -5,20 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"net/netip"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/tunnel"
 	"github.com/drio/spanza/wgbind"
-	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun"
-	"golang.zx2c4.com/wireguard/tun/netstack"
-	"tailscale.com/derp/derphttp"
-	"tailscale.com/net/netmon"
-	"tailscale.com/types/key"
 )
 
 // Network configuration
@@ -26,6 +21,9 @@ import (
 const (
 	derpURL = "https://derp.tailscale.com/derp"
 
+	// How many times to try reaching DERP at startup before giving up
+	derpConnectAttempts = 5
+
 	// Client peer IPs
 	clientIP = "192.168.4.2"
 	serverIP = "192.168.4.1"
@@ -54,6 +52,11 @@ func main() {
 	log.Println("This client uses DerpBind (same as WASM) for testing")
 	log.Println("")
 
+	// Catch copy-paste mistakes in the key constants before anything starts
+	if err := validateKeys(); err != nil {
+		log.Fatalf("Invalid key configuration: %v", err)
+	}
+
 	// Create a context that we can cancel on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -69,95 +72,72 @@ func main() {
 
 	// Step 1: Create DERP client and DerpBind
 	log.Println("Step 1: Creating DERP client and DerpBind...")
-	derpBind, err := createDerpBind()
+	derpBind, err := createDerpBind(ctx)
 	if err != nil {
 		log.Fatalf("Failed to create DerpBind: %v", err)
 	}
 
-	// Step 2: Create userspace network stack
-	log.Printf("Step 2: Creating userspace network stack on %s...", clientIP)
-	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(clientIP)},
-		[]netip.Addr{netip.MustParseAddr(dnsIP)},
-		1420, // MTU
-	)
+	// Step 2: Create the userspace network stack and WireGuard device
+	log.Printf("Step 2: Creating WireGuard tunnel on %s with DERP transport...", clientIP)
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    clientIP,
+		DNS:        dnsIP,
+		MTU:        wgbind.RecommendedMTU(wgbind.TransportDERP),
+		PrivateKey: peerClientWGPrivate,
+		// Note: NO ListenPort (we're not using UDP)
+		Peer: tunnel.PeerConfig{
+			PublicKey: peerServerWGPublic,
+			// Endpoint is the DERP node key (not IP:port)
+			Endpoint:            peerServerDERPPublic,
+			PersistentKeepalive: 25,
+		},
+		Bind:      derpBind,
+		LogPrefix: "[wg] ",
+	})
 	if err != nil {
-		log.Fatalf("Failed to create TUN: %v", err)
+		log.Fatalf("Failed to create tunnel: %v", err)
 	}
 
-	// Step 3: Start the WireGuard client with DerpBind
-	log.Println("Step 3: Starting WireGuard peer with DERP transport...")
-	runWireGuardClient(ctx, tun, tnet, derpBind)
+	// Step 3: Make an HTTP request through the tunnel
+	log.Println("Step 3: Talking to the server peer through the tunnel...")
+	runWireGuardClient(ctx, tun)
 }
 
-// createDerpBind creates a DERP client and DerpBind for native Go
-func createDerpBind() (*wgbind.DerpBind, error) {
-	log.Printf("Connecting to DERP server: %s", derpURL)
-
-	// Parse our DERP private key
-	var privKey key.NodePrivate
-	if err := privKey.UnmarshalText([]byte(peerClientDERPPrivate)); err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
-	}
-
-	// Parse server's DERP public key
-	var remotePubKey key.NodePublic
-	if err := remotePubKey.UnmarshalText([]byte(peerServerDERPPublic)); err != nil {
-		return nil, fmt.Errorf("failed to parse remote public key: %w", err)
+// validateKeys checks that each hardcoded public key matches its private key
+func validateKeys() error {
+	if err := keys.CheckDERPPair(peerClientDERPPrivate, peerClientDERPPublic); err != nil {
+		return err
 	}
+	return keys.CheckWireGuardPair(peerClientWGPrivate, peerClientWGPublic)
+}
 
-	// Create DERP client
-	netMon := netmon.NewStatic()
-	logf := func(format string, args ...any) {
-		log.Printf("[derp] "+format, args...)
-	}
+// createDerpBind creates a DERP client and DerpBind for native Go
+func createDerpBind(ctx context.Context) (*wgbind.DerpBind, error) {
+	log.Printf("Connecting to DERP server: %s", derpURL)
 
-	derpClient, err := derphttp.NewClient(privKey, derpURL, logf, netMon)
+	derpBind, err := wgbind.NewDerpBindFromConfig(wgbind.DerpBindConfig{
+		DerpURL:         derpURL,
+		PrivKeyStr:      peerClientDERPPrivate,
+		RemotePubKeyStr: peerServerDERPPublic,
+	}, wgbind.WithSourceFilter())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DERP client: %w", err)
+		return nil, err
 	}
 
-	log.Println("✓ DERP client created")
+	// Fail now rather than start a device that can never handshake
+	if err := derpBind.Connect(ctx, derpConnectAttempts, time.Second); err != nil {
+		// The bind was never opened, so its Close would leave the client be
+		derpBind.Client().Close()
+		return nil, err
+	}
 
-	// Create DerpBind for WireGuard
-	derpBind := wgbind.NewDerpBind(derpClient, remotePubKey)
-	log.Println("✓ DerpBind created")
+	log.Println("✓ DERP client and DerpBind created")
 
 	return derpBind, nil
 }
 
-// runWireGuardClient creates the userspace WireGuard device and makes HTTP request
-func runWireGuardClient(ctx context.Context, tunDev tun.Device, tnet *netstack.Net, derpBind *wgbind.DerpBind) {
-	log.Printf("Creating userspace WireGuard device with DERP transport...")
-
-	// Create WireGuard device using DerpBind (no UDP!)
-	// This wraps the TUN interface and handles WireGuard protocol:
-	// - Encryption/decryption
-	// - Handshakes
-	// - Peer management
-	// DerpBind uses DERP directly for all communication (like Tailscale in WASM)
-	dev := device.NewDevice(tunDev, derpBind, device.NewLogger(device.LogLevelSilent, "[wg] "))
-
-	// Configure WireGuard
-	// Note: NO listen_port (we're not using UDP)
-	// endpoint is the DERP node key (not IP:port)
-	wgConfig := fmt.Sprintf(`private_key=%s
-public_key=%s
-endpoint=%s
-allowed_ip=0.0.0.0/0
-persistent_keepalive_interval=25
-`, peerClientWGPrivate, peerServerWGPublic, peerServerDERPPublic)
-
-	log.Println("Configuring WireGuard peer...")
-	if err := dev.IpcSet(wgConfig); err != nil {
-		log.Fatalf("Failed to configure WireGuard: %v", err)
-	}
-
-	// Bring the WireGuard interface up
-	if err := dev.Up(); err != nil {
-		log.Fatalf("Failed to bring up WireGuard: %v", err)
-	}
-
+// runWireGuardClient makes an HTTP request through the tunnel
+func runWireGuardClient(ctx context.Context, tun *tunnel.Tunnel) {
 	log.Println("✓ WireGuard device is up")
 	log.Printf("  Address: %s", clientIP)
 	log.Printf("  Transport: DERP (no UDP)")
@@ -173,14 +153,10 @@ persistent_keepalive_interval=25
 	log.Println("Making HTTP request through tunnel...")
 	log.Println("─────────────────────────────────────────")
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: tnet.DialContext, // Routes through WireGuard!
-		},
-		Timeout: 10 * time.Second,
-	}
+	client := tun.HTTPClient() // Routes through WireGuard!
+	client.Timeout = 10 * time.Second
 
-	targetURL := fmt.Sprintf("http://%s/", serverIP)
+	targetURL := fmt.Sprintf("http://%s/", net.JoinHostPort(serverIP, "80"))
 	log.Printf("GET %s", targetURL)
 
 	resp, err := client.Get(targetURL)
@@ -205,5 +181,5 @@ persistent_keepalive_interval=25
 
 	// Keep running until interrupted
 	<-ctx.Done()
-	dev.Close()
+	tun.Close()
 }
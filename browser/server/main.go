@@ -2,23 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
-	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/tunnel"
 	"github.com/drio/spanza/wgbind"
-	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun"
-	"golang.zx2c4.com/wireguard/tun/netstack"
-	"tailscale.com/derp/derphttp"
-	"tailscale.com/net/netmon"
-	"tailscale.com/types/key"
 )
 
 // Network configuration
@@ -26,6 +23,9 @@ import (
 const (
 	derpURL = "https://derp.tailscale.com/derp"
 
+	// How many times to try reaching DERP at startup before giving up
+	derpConnectAttempts = 5
+
 	// Server peer IPs
 	serverIP = "192.168.4.1"
 	dnsIP    = "8.8.8.8"
@@ -48,10 +48,22 @@ const (
 	browserIP             = "192.168.4.2"
 )
 
+// Browsers using their own persistent DERP key (the "Use this browser's own
+// DERP key" checkbox) aren't peerBrowserDERPPublic; getPublicKey() in the
+// browser shows the key to pass here.
+var browserDERPKey = flag.String("browser-derp-key", peerBrowserDERPPublic, "DERP public key (nodekey:...) of the browser peer")
+
 func main() {
+	flag.Parse()
+
 	log.Println("Starting WireGuard server peer with DerpBind...")
 	log.Println("")
 
+	// Catch copy-paste mistakes in the key constants before anything starts
+	if err := validateKeys(); err != nil {
+		log.Fatalf("Invalid key configuration: %v", err)
+	}
+
 	// Create a context that we can cancel on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -67,95 +79,82 @@ func main() {
 
 	// Step 1: Create DERP client and DerpBind
 	log.Println("Step 1: Creating DERP client and DerpBind...")
-	derpBind, err := createDerpBind()
+	derpBind, err := createDerpBind(ctx)
 	if err != nil {
 		log.Fatalf("Failed to create DerpBind: %v", err)
 	}
 
-	// Step 2: Create userspace network stack
-	log.Printf("Step 2: Creating userspace network stack on %s...", serverIP)
-	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(serverIP)},
-		[]netip.Addr{netip.MustParseAddr(dnsIP)},
-		1420, // MTU
-	)
+	// Step 2: Create the userspace network stack and WireGuard device
+	log.Printf("Step 2: Creating WireGuard tunnel on %s with DERP transport...", serverIP)
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    serverIP,
+		DNS:        dnsIP,
+		MTU:        wgbind.RecommendedMTU(wgbind.TransportDERP),
+		PrivateKey: peerServerWGPrivate,
+		// Note: NO ListenPort (we're not using UDP)
+		Peer: tunnel.PeerConfig{
+			PublicKey: peerBrowserWGPublic,
+			// Endpoint is the DERP node key (not IP:port)
+			Endpoint:            *browserDERPKey,
+			PersistentKeepalive: 25,
+		},
+		Bind:      derpBind,
+		LogPrefix: "[wg-server] ",
+	})
 	if err != nil {
-		log.Fatalf("Failed to create TUN: %v", err)
+		log.Fatalf("Failed to create tunnel: %v", err)
 	}
 
-	// Step 3: Start the WireGuard peer with HTTP server
-	log.Println("Step 3: Starting WireGuard peer with DERP transport...")
-	runWireGuardPeer(ctx, tun, tnet, derpBind)
+	// Step 3: Serve HTTP through the tunnel
+	log.Println("Step 3: Starting HTTP server inside the tunnel...")
+	runWireGuardPeer(ctx, tun, derpBind)
 }
 
-// createDerpBind creates a DERP client and DerpBind for the server
-func createDerpBind() (*wgbind.DerpBind, error) {
-	log.Printf("Connecting to DERP server: %s", derpURL)
-
-	// Parse our DERP private key
-	var privKey key.NodePrivate
-	if err := privKey.UnmarshalText([]byte(peerServerDERPPrivate)); err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+// validateKeys checks that each hardcoded public key matches its private key,
+// and that the browser's DERP key parses
+func validateKeys() error {
+	if err := keys.CheckDERPPair(peerServerDERPPrivate, peerServerDERPPublic); err != nil {
+		return err
 	}
-
-	// Parse browser's DERP public key
-	var remotePubKey key.NodePublic
-	if err := remotePubKey.UnmarshalText([]byte(peerBrowserDERPPublic)); err != nil {
-		return nil, fmt.Errorf("failed to parse remote public key: %w", err)
+	if _, err := keys.ParseNodePublic(*browserDERPKey); err != nil {
+		return fmt.Errorf("-browser-derp-key: %w", err)
 	}
+	return keys.CheckWireGuardPair(peerServerWGPrivate, peerServerWGPublic)
+}
+
+// createDerpBind creates a DERP client and DerpBind for the server
+func createDerpBind(ctx context.Context) (*wgbind.DerpBind, error) {
+	log.Printf("Connecting to DERP server: %s", derpURL)
 
-	// Create DERP client
-	netMon := netmon.NewStatic()
-	logf := func(format string, args ...any) {
-		log.Printf("[derp] "+format, args...)
+	cfg := wgbind.DerpBindConfig{
+		DerpURL:         derpURL,
+		PrivKeyStr:      peerServerDERPPrivate,
+		RemotePubKeyStr: *browserDERPKey,
 	}
 
-	derpClient, err := derphttp.NewClient(privKey, derpURL, logf, netMon)
+	// Probe the DERP round-trip time so /status can report it
+	derpBind, err := wgbind.NewDerpBindFromConfig(cfg,
+		wgbind.WithRTTProbe(15*time.Second),
+		wgbind.WithSourceFilter(),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DERP client: %w", err)
+		return nil, err
 	}
 
-	log.Println("✓ DERP client created")
+	// Fail now rather than start a device that can never handshake
+	if err := derpBind.Connect(ctx, derpConnectAttempts, time.Second); err != nil {
+		// The bind was never opened, so its Close would leave the client be
+		derpBind.Client().Close()
+		return nil, err
+	}
 
-	// Create DerpBind for WireGuard
-	derpBind := wgbind.NewDerpBind(derpClient, remotePubKey)
-	log.Println("✓ DerpBind created")
+	log.Println("✓ DERP client and DerpBind created")
 
 	return derpBind, nil
 }
 
-// runWireGuardPeer creates the userspace WireGuard device and HTTP server
-func runWireGuardPeer(ctx context.Context, tunDev tun.Device, tnet *netstack.Net, derpBind *wgbind.DerpBind) {
-	log.Printf("Creating userspace WireGuard device with DERP transport...")
-
-	// Create WireGuard device using DerpBind (no UDP!)
-	// This wraps the TUN interface and handles WireGuard protocol:
-	// - Encryption/decryption
-	// - Handshakes
-	// - Peer management
-	// DerpBind uses DERP directly for all communication (like Tailscale in WASM)
-	dev := device.NewDevice(tunDev, derpBind, device.NewLogger(device.LogLevelSilent, "[wg-server] "))
-
-	// Configure WireGuard
-	// Note: NO listen_port (we're not using UDP)
-	// endpoint is the DERP node key (not IP:port)
-	wgConfig := fmt.Sprintf(`private_key=%s
-public_key=%s
-endpoint=%s
-allowed_ip=0.0.0.0/0
-persistent_keepalive_interval=25
-`, peerServerWGPrivate, peerBrowserWGPublic, peerBrowserDERPPublic)
-
-	log.Println("Configuring WireGuard peer...")
-	if err := dev.IpcSet(wgConfig); err != nil {
-		log.Fatalf("Failed to configure WireGuard: %v", err)
-	}
-
-	// Bring the WireGuard interface up
-	if err := dev.Up(); err != nil {
-		log.Fatalf("Failed to bring up WireGuard: %v", err)
-	}
-
+// runWireGuardPeer runs the HTTP server inside the tunnel
+func runWireGuardPeer(ctx context.Context, tun *tunnel.Tunnel, derpBind *wgbind.DerpBind) {
 	log.Println("✓ WireGuard device is up")
 	log.Printf("  Address: %s", serverIP)
 	log.Printf("  Transport: DERP (no UDP)")
@@ -165,7 +164,7 @@ persistent_keepalive_interval=25
 	// This server is only accessible through the WireGuard tunnel
 	log.Printf("Starting HTTP server on %s:80...", serverIP)
 
-	listener, err := tnet.ListenTCP(&net.TCPAddr{Port: 80})
+	listener, err := tun.ListenTCP(80)
 	if err != nil {
 		log.Fatalf("Failed to create listener: %v", err)
 	}
@@ -180,7 +179,30 @@ persistent_keepalive_interval=25
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Status request from %s", r.RemoteAddr)
 		w.Header().Set("Content-Type", "application/json")
-		io.WriteString(w, `{"status":"ok","server":"wireguard","ip":"`+serverIP+`"}`)
+
+		// Round-trip times to the DERP server, in milliseconds
+		latest, history := derpBind.RTT()
+		historyMs := make([]float64, len(history))
+		for i, rtt := range history {
+			historyMs[i] = float64(rtt) / float64(time.Millisecond)
+		}
+
+		resp := map[string]any{
+			"status":              "ok",
+			"server":              "wireguard",
+			"ip":                  serverIP,
+			"derp_rtt_ms":         float64(latest) / float64(time.Millisecond),
+			"derp_rtt_history_ms": historyMs,
+		}
+
+		// Per-peer handshake and traffic counters from the device
+		if wg, err := tun.Status(); err != nil {
+			log.Printf("Failed to get WireGuard status: %v", err)
+		} else {
+			resp["wireguard"] = wg
+		}
+
+		json.NewEncoder(w).Encode(resp)
 	})
 
 	log.Println("✓ HTTP server ready")
@@ -195,7 +217,7 @@ persistent_keepalive_interval=25
 		<-ctx.Done()
 		srv.Close()
 		listener.Close()
-		dev.Close()
+		tun.Close()
 	}()
 
 	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall/js"
+
+	"github.com/drio/spanza/keys"
+	"tailscale.com/types/key"
+)
+
+// derpKeyStorageKey is where a persistent DERP private key is kept in the
+// browser's localStorage.
+const derpKeyStorageKey = "spanza.derpPrivateKey"
+
+// resolveDERPKey picks the DERP private key ("privkey:...") for this
+// browser from a JavaScript options object:
+//
+//   - {derpPrivateKey: "privkey:..."} uses the given key
+//   - {persistentKey: true} uses a key kept in localStorage, generating and
+//     storing one on first use, so each browser has a stable identity of its
+//     own across reloads
+//   - otherwise the browserDERPPrivate constant, which the server example
+//     expects
+func resolveDERPKey(opts js.Value) (string, error) {
+	if opts.Type() != js.TypeObject {
+		return browserDERPPrivate, nil
+	}
+
+	if v := opts.Get("derpPrivateKey"); v.Type() == js.TypeString && v.String() != "" {
+		if _, err := keys.ParseNodePrivate(v.String()); err != nil {
+			return "", err
+		}
+		return v.String(), nil
+	}
+
+	if v := opts.Get("persistentKey"); v.Type() == js.TypeBoolean && v.Bool() {
+		return persistentDERPKey()
+	}
+
+	return browserDERPPrivate, nil
+}
+
+// persistentDERPKey returns the DERP private key stored in localStorage,
+// generating and storing a new one if there is none (or it is corrupt).
+func persistentDERPKey() (string, error) {
+	storage := js.Global().Get("localStorage")
+	if storage.IsUndefined() || storage.IsNull() {
+		return "", fmt.Errorf("localStorage not available")
+	}
+
+	if v := storage.Call("getItem", derpKeyStorageKey); v.Type() == js.TypeString {
+		if _, err := keys.ParseNodePrivate(v.String()); err == nil {
+			return v.String(), nil
+		}
+		log.Printf("✗ Stored DERP key is invalid, generating a new one")
+	}
+
+	text, err := key.NewNode().MarshalText()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate DERP key: %w", err)
+	}
+	storage.Call("setItem", derpKeyStorageKey, string(text))
+	log.Println("✓ Generated a new DERP key and saved it in localStorage")
+
+	return string(text), nil
+}
+
+// getPublicKey returns the DERP public key ("nodekey:...") and the WireGuard
+// public key (hex) this browser uses, so the peer can be told what to expect.
+// It takes the same options as createWireGuard; once connected it reports
+// the keys in use.
+func getPublicKey(this js.Value, args []js.Value) interface{} {
+	privStr := derpPrivateKey
+	peerCfg := peer
+	if wgDevice == nil {
+		var opts js.Value
+		if len(args) > 0 {
+			opts = args[0]
+		}
+		var err error
+		if privStr, err = resolveDERPKey(opts); err != nil {
+			return errorResponse(err.Error())
+		}
+		if peerCfg, err = parsePeerConfig(opts); err != nil {
+			return errorResponse(err.Error())
+		}
+	}
+
+	priv, err := keys.ParseNodePrivate(privStr)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+	wgPub, err := keys.WireGuardPublicKey(peerCfg.wgPrivate)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+
+	return map[string]interface{}{
+		"success":     true,
+		"publicKey":   priv.Public().String(),
+		"wgPublicKey": wgPub,
+	}
+}
@@ -5,27 +5,28 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"strings"
 	"syscall/js"
 	"time"
 
+	"github.com/drio/spanza/keys"
 	"github.com/drio/spanza/wgbind"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 	"tailscale.com/derp/derphttp"
-	"tailscale.com/net/netmon"
-	"tailscale.com/types/key"
 )
 
 // Configuration - same keys as server peer
 const (
-	// DERP server
-	derpURL = "https://derp.tailscale.com/derp"
+	// Default DERP server, JavaScript can pass another one to createWireGuard()
+	defaultDERPURL = "https://derp.tailscale.com/derp"
 
-	// Browser peer network config
+	// Default browser peer network config, see parsePeerConfig
 	browserIP = "192.168.4.2"
 	serverIP  = "192.168.4.1"
 	dnsIP     = "8.8.8.8"
@@ -37,18 +38,28 @@ const (
 	// Browser's WireGuard keys (for tunnel encryption)
 	browserWGPrivate = "10a216bad1190b9ebabb373061bd112a3d27d11ab005c0c5bce05c9c7e8eb85f"
 
-	// Server's keys (to configure as peer)
+	// Server's keys (the default peer)
 	serverDERPPublic = "nodekey:4b115ea75d1aeb08d489d9b9015f4b8228a60e1cfe4e231332e29bc4da71f659"
 	serverWGPublic   = "f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c"
 )
 
 // Global state
 var (
-	wgDevice   *device.Device    // The WireGuard device
-	derpClient *derphttp.Client  // The DERP client (for DerpBind)
-	tnet       *netstack.Net     // Userspace network stack
-	ctx        context.Context
-	cancel     context.CancelFunc
+	wgDevice *device.Device   // The WireGuard device
+	derpBind *wgbind.DerpBind // The DERP bind (for reconnectDERP)
+	tnet     *netstack.Net    // Userspace network stack
+	derpURL  = defaultDERPURL // DERP server in use
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// DERP private key in use, see resolveDERPKey
+	derpPrivateKey = browserDERPPrivate
+
+	// Tunnel peer and addresses in use, see parsePeerConfig
+	peer = defaultPeerConfig()
+
+	// How long to wait for the WireGuard handshake before giving up
+	handshakeTimeout = 15 * time.Second
 )
 
 // main is the entry point for the WASM module.
@@ -64,13 +75,17 @@ func main() {
 	js.Global().Set("getStatus", js.FuncOf(getStatus))
 	js.Global().Set("fetchHTTP", js.FuncOf(fetchHTTP))
 	js.Global().Set("pingPeer", js.FuncOf(pingPeer))
+	js.Global().Set("reconnectDERP", js.FuncOf(reconnectDERP))
+	js.Global().Set("getPublicKey", js.FuncOf(getPublicKey))
 
 	log.Println("Functions exposed to JavaScript:")
 	log.Println("  - hello()           : Simple test function")
 	log.Println("  - createWireGuard() : Setup WireGuard + DerpBind + DERP connection")
 	log.Println("  - getStatus()       : Get connection status")
 	log.Println("  - fetchHTTP()       : Fetch HTTP through tunnel")
-	log.Println("  - pingPeer()        : Test connection to peer")
+	log.Println("  - pingPeer()        : Measure round trip to peer")
+	log.Println("  - reconnectDERP()   : Reconnect to DERP after a network change")
+	log.Println("  - getPublicKey()    : Get this browser's DERP public key")
 
 	// Keep the Go program running forever
 	<-make(chan struct{})
@@ -99,11 +114,46 @@ func createWireGuard(this js.Value, args []js.Value) interface{} {
 		}
 	}
 
+	// Optional config object:
+	// createWireGuard({derpURL: "https://derp.example.com/derp", persistentKey: true})
+	// See resolveDERPKey for the DERP key options and parsePeerConfig for
+	// the peer's keys and the tunnel addresses.
+	var opts js.Value
+	if len(args) > 0 && args[0].Type() == js.TypeObject {
+		opts = args[0]
+		if v := opts.Get("derpURL"); v.Type() == js.TypeString && v.String() != "" {
+			if err := validateDERPURL(v.String()); err != nil {
+				return errorResponse(err.Error())
+			}
+			derpURL = v.String()
+		}
+	}
+
+	peerCfg, err := parsePeerConfig(opts)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+	peer = peerCfg
+
+	privStr, err := resolveDERPKey(opts)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+	derpPrivateKey = privStr
+
+	// Catch copy-paste mistakes in the key constants before connecting
+	if derpPrivateKey == browserDERPPrivate {
+		if err := keys.CheckDERPPair(browserDERPPrivate, browserDERPPublic); err != nil {
+			return errorResponse(err.Error())
+		}
+	}
+
 	// Step 1: Create DERP client and bind
-	derpBind, err := createDerpBind()
+	bind, err := createDerpBind()
 	if err != nil {
 		return errorResponse(err.Error())
 	}
+	derpBind = bind
 
 	// Step 2: Create userspace network stack
 	tunDev, tnetLocal, err := createNetworkStack()
@@ -132,12 +182,17 @@ func createWireGuard(this js.Value, args []js.Value) interface{} {
 
 	printSuccessMessage()
 
+	status := "connected"
+	if !handshakeComplete() {
+		status = "connecting"
+	}
+
 	return map[string]interface{}{
 		"success":   true,
-		"localIP":   browserIP,
-		"peerIP":    serverIP,
+		"localIP":   peer.localIP.String(),
+		"peerIP":    peer.peerIP.String(),
 		"derpURL":   derpURL,
-		"status":    "connected",
+		"status":    status,
 		"transport": "websocket+derpbind",
 	}
 }
@@ -146,39 +201,44 @@ func createWireGuard(this js.Value, args []js.Value) interface{} {
 func createDerpBind() (*wgbind.DerpBind, error) {
 	log.Printf("→ Connecting to DERP server: %s", derpURL)
 
-	// Parse our DERP private key
-	var privKey key.NodePrivate
-	if err := privKey.UnmarshalText([]byte(browserDERPPrivate)); err != nil {
-		return nil, fmt.Errorf("failed to parse key: %w", err)
-	}
-
-	// Parse server's DERP public key
-	var remotePubKey key.NodePublic
-	if err := remotePubKey.UnmarshalText([]byte(serverDERPPublic)); err != nil {
-		return nil, fmt.Errorf("failed to parse remote key: %w", err)
-	}
-
-	// Create DERP client (WebSocket used automatically in browser)
-	netMon := netmon.NewStatic()
-	logf := func(format string, args ...any) {
-		// Suppress most DERP logging - retries are normal during connection
-		// Only log critical errors, not routine connection attempts
-		msg := fmt.Sprintf(format, args...)
-		if strings.Contains(msg, "context deadline exceeded") {
-			// WebSocket timeout during connection - normal, suppress
-			return
-		}
-		if strings.Contains(msg, "error") || strings.Contains(msg, "failed") {
-			log.Printf("[derp] "+format, args...)
-		}
+	cfg := wgbind.DerpBindConfig{
+		DerpURL:         derpURL,
+		PrivKeyStr:      derpPrivateKey,
+		RemotePubKeyStr: peer.derpPublic,
+		Logf: func(format string, args ...any) {
+			// Suppress most DERP logging - retries are normal during connection
+			// Only log critical errors, not routine connection attempts
+			msg := fmt.Sprintf(format, args...)
+			if strings.Contains(msg, "context deadline exceeded") {
+				// WebSocket timeout during connection - normal, suppress
+				return
+			}
+			if strings.Contains(msg, "error") || strings.Contains(msg, "failed") {
+				log.Printf("[derp] "+format, args...)
+			}
+		},
+		SetupClient: setupDERPClient,
 	}
 
-	var err error
-	derpClient, err = derphttp.NewClient(privKey, derpURL, logf, netMon)
+	// The config's dialer lets reconnectDERP replace the connection after a
+	// network change (WebSocket used automatically in browser)
+	bind, err := wgbind.NewDerpBindFromConfig(cfg,
+		wgbind.WithSourceFilter(),
+		wgbind.WithStateCallbacks(
+			func() { notifyDERPState("connected") },
+			func() { notifyDERPState("disconnected") },
+		),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create DERP client: %w", err)
+		return nil, err
 	}
+	log.Println("✓ DERP client and DerpBind created")
+
+	return bind, nil
+}
 
+// setupDERPClient adjusts a DERP client for the browser
+func setupDERPClient(derpClient *derphttp.Client) {
 	// In WASM/browser, WebSocket connections take longer to establish
 	// Use a 30-second timeout instead of the default 10 seconds
 	derpClient.BaseContext = func() context.Context {
@@ -187,24 +247,36 @@ func createDerpBind() (*wgbind.DerpBind, error) {
 	}
 
 	// In WASM/browser, we need to use http.DefaultClient for WebSocket to work
+	// TLS (including custom certificates for self-hosted DERP) is up to the
+	// browser, there is nothing to configure on our side
 	derpClient.TLSConfig = nil // Use browser's TLS
+}
 
-	// Create DerpBind for WireGuard
-	derpBind := wgbind.NewDerpBind(derpClient, remotePubKey)
-	log.Println("✓ DERP client and DerpBind created")
-
-	return derpBind, nil
+// validateDERPURL checks that s is an http(s) URL the DERP client can dial.
+// The path is kept as given, so self-hosted servers can use a custom one.
+func validateDERPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid DERP URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("invalid DERP URL %q: scheme must be https or http", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid DERP URL %q: missing host", s)
+	}
+	return nil
 }
 
 // createNetworkStack creates the userspace network stack and TUN device
 // Returns both the TUN device and the network stack for the caller to manage
 func createNetworkStack() (tun.Device, *netstack.Net, error) {
-	log.Printf("→ Creating network stack (IP: %s)", browserIP)
+	log.Printf("→ Creating network stack (IP: %s)", peer.localIP)
 
 	tunDev, tnetLocal, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(browserIP)},
+		[]netip.Addr{peer.localIP},
 		[]netip.Addr{netip.MustParseAddr(dnsIP)},
-		1420, // MTU
+		wgbind.RecommendedMTU(wgbind.TransportDERPWebSocket),
 	)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create network stack: %w", err)
@@ -237,8 +309,9 @@ func configureWireGuardPeer() error {
 public_key=%s
 endpoint=%s
 allowed_ip=0.0.0.0/0
+allowed_ip=::/0
 persistent_keepalive_interval=25
-`, browserWGPrivate, serverWGPublic, serverDERPPublic)
+`, peer.wgPrivate, peer.wgPublic, peer.derpPublic)
 
 	if err := wgDevice.IpcSet(wgConfig); err != nil {
 		return fmt.Errorf("failed to configure: %w", err)
@@ -265,27 +338,59 @@ func waitForHandshake() {
 	log.Println("→ Waiting for WireGuard handshake...")
 	log.Println("   (Make sure the server is running first!)")
 
-	// Give WireGuard time to complete the handshake
 	// The handshake involves:
 	// 1. Browser sends initiation packet via DERP
 	// 2. Server responds via DERP
 	// 3. Both sides derive session keys
 	// In WASM with DERP relay, this can take 5-10 seconds
-	for i := 0; i < 8; i++ {
-		time.Sleep(1 * time.Second)
-		if i == 3 {
-			log.Println("   Still waiting... (handshake packets traveling via DERP)")
+	if err := waitForReady(handshakeTimeout); err != nil {
+		log.Printf("   %v (fetchHTTP/pingPeer will keep waiting)", err)
+		return
+	}
+
+	log.Println("✓ Handshake complete")
+}
+
+// waitForReady blocks until the WireGuard handshake with the server has
+// completed, or returns a "still connecting" error after timeout.
+func waitForReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if handshakeComplete() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still connecting: no WireGuard handshake after %s", timeout)
 		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// handshakeComplete reports whether the device has a completed handshake,
+// based on last_handshake_time_sec from the device's IPC state.
+func handshakeComplete() bool {
+	if wgDevice == nil {
+		return false
+	}
+
+	state, err := wgDevice.IpcGet()
+	if err != nil {
+		return false
 	}
 
-	log.Println("✓ Handshake wait complete")
+	for _, line := range strings.Split(state, "\n") {
+		if v, ok := strings.CutPrefix(line, "last_handshake_time_sec="); ok && v != "0" {
+			return true
+		}
+	}
+	return false
 }
 
 // printSuccessMessage prints the success message after WireGuard is up
 func printSuccessMessage() {
 	log.Println("")
 	log.Println("🎉 Tunnel ready!")
-	log.Printf("  Local: %s → Peer: %s", browserIP, serverIP)
+	log.Printf("  Local: %s → Peer: %s", peer.localIP, peer.peerIP)
 	log.Printf("  Transport: DERP via WebSocket")
 	log.Println("")
 	log.Println("You can now use fetchHTTP() or pingPeer() to test the tunnel")
@@ -299,6 +404,24 @@ func errorResponse(message string) map[string]interface{} {
 	}
 }
 
+// reconnectDERP replaces the DERP connection, e.g. after the laptop slept or
+// switched networks and the WebSocket died. The WireGuard device stays up.
+func reconnectDERP(this js.Value, args []js.Value) interface{} {
+	if derpBind == nil {
+		return errorResponse("WireGuard not initialized. Call createWireGuard() first")
+	}
+
+	if err := derpBind.Reconnect(); err != nil {
+		log.Printf("✗ %v", err)
+		return errorResponse(err.Error())
+	}
+
+	return map[string]interface{}{
+		"success": true,
+		"derpURL": derpURL,
+	}
+}
+
 // getStatus returns the current status of the WireGuard device
 func getStatus(this js.Value, args []js.Value) interface{} {
 	if wgDevice == nil {
@@ -308,15 +431,30 @@ func getStatus(this js.Value, args []js.Value) interface{} {
 		}
 	}
 
+	derpState := "disconnected"
+	if derpBind != nil && derpBind.Connected() {
+		derpState = "connected"
+	}
+
 	return map[string]interface{}{
 		"exists":  true,
-		"localIP": browserIP,
-		"peerIP":  serverIP,
+		"localIP": peer.localIP.String(),
+		"peerIP":  peer.peerIP.String(),
 		"status":  "device_up",
+		"derp":    derpState,
+	}
+}
+
+// notifyDERPState tells the page about DERP connection changes by calling
+// the JavaScript function onDERPStateChange(state), if the page defines one.
+func notifyDERPState(state string) {
+	log.Printf("DERP %s", state)
+	if fn := js.Global().Get("onDERPStateChange"); fn.Type() == js.TypeFunction {
+		fn.Invoke(state)
 	}
 }
 
-// pingPeer sends an ICMP ping through the WireGuard tunnel
+// pingPeer measures the round-trip time to the peer through the tunnel
 func pingPeer(this js.Value, args []js.Value) interface{} {
 	if tnet == nil {
 		return map[string]interface{}{
@@ -325,9 +463,17 @@ func pingPeer(this js.Value, args []js.Value) interface{} {
 		}
 	}
 
-	log.Printf("→ Testing connection to %s:80...", serverIP)
+	if err := waitForReady(handshakeTimeout); err != nil {
+		log.Printf("✗ %v", err)
+		return errorResponse(err.Error())
+	}
+
+	log.Printf("→ Measuring round trip to %s:80...", peer.peerIP)
 
-	conn, err := tnet.DialContext(context.Background(), "tcp", serverIP+":80")
+	// A TCP handshake is one full round trip through the tunnel: browser ->
+	// DERP -> server and back, so time the connect
+	start := time.Now()
+	conn, err := tnet.DialContext(context.Background(), "tcp", net.JoinHostPort(peer.peerIP.String(), "80"))
 	if err != nil {
 		log.Printf("✗ Connection failed: %v", err)
 		return map[string]interface{}{
@@ -335,15 +481,29 @@ func pingPeer(this js.Value, args []js.Value) interface{} {
 			"error":   fmt.Sprintf("Connection failed: %v", err),
 		}
 	}
-	defer conn.Close()
+	rtt := time.Since(start)
+	conn.Close()
 
-	log.Println("✓ Connection successful!")
-
-	return map[string]interface{}{
+	resp := map[string]interface{}{
 		"success": true,
-		"message": fmt.Sprintf("Successfully connected to %s:80", serverIP),
-		"bytes":   0,
+		"message": fmt.Sprintf("Round trip to %s: %.1f ms", peer.peerIP, durationMs(rtt)),
+		"rtt_ms":  durationMs(rtt),
 	}
+
+	// Our leg of it, to the DERP server
+	if derpRTT, err := derpBind.Ping(5 * time.Second); err != nil {
+		log.Printf("DERP ping failed: %v", err)
+	} else {
+		resp["derp_rtt_ms"] = durationMs(derpRTT)
+	}
+
+	log.Printf("✓ %s", resp["message"])
+	return resp
+}
+
+// durationMs converts d to (fractional) milliseconds for JS
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
 }
 
 // fetchHTTP makes an HTTP request through the WireGuard tunnel
@@ -355,7 +515,12 @@ func fetchHTTP(this js.Value, args []js.Value) interface{} {
 		}
 	}
 
-	url := fmt.Sprintf("http://%s/", serverIP)
+	if err := waitForReady(handshakeTimeout); err != nil {
+		log.Printf("✗ %v", err)
+		return errorResponse(err.Error())
+	}
+
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(peer.peerIP.String(), "80"))
 	log.Printf("→ Fetching %s...", url)
 
 	httpClient := &http.Client{
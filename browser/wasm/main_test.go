@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall/js"
+	"testing"
+	"time"
+
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/tunnel"
+	"github.com/drio/spanza/wgbind"
+	"tailscale.com/types/key"
+)
+
+// harness is the browser side set up the way createWireGuard does it, but
+// with its DerpBind on an in-memory DERP connection instead of a WebSocket.
+// startServer brings up the peer on the other end.
+type harness struct {
+	browserDERP key.NodePublic
+	serverConn  *wgbind.MemDERPConn
+	serverWG    string // Server's WireGuard private key, hex
+	browserWG   string // Browser's WireGuard public key, hex
+}
+
+// newHarness brings up the browser's device, with no server answering yet.
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+
+	browserDERP, serverDERP := key.NewNode(), key.NewNode()
+	browserConn, serverConn := wgbind.NewMemDERPPair(browserDERP.Public(), serverDERP.Public())
+
+	browserPriv, browserPub := newWireGuardKeys(t)
+	serverPriv, serverPub := newWireGuardKeys(t)
+
+	peer = peerConfig{
+		derpPublic: serverDERP.Public().String(),
+		wgPublic:   serverPub,
+		wgPrivate:  browserPriv,
+		localIP:    netip.MustParseAddr("10.0.0.2"),
+		peerIP:     netip.MustParseAddr("10.0.0.1"),
+	}
+	derpBind = wgbind.NewDerpBind(browserConn, serverDERP.Public())
+
+	tunDev, tnetLocal, err := createNetworkStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tnet = tnetLocal
+	if err := createWireGuardDevice(tunDev, derpBind); err != nil {
+		t.Fatal(err)
+	}
+	if err := configureWireGuardPeer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bringWireGuardUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		wgDevice.Close()
+		wgDevice, derpBind, tnet = nil, nil, nil
+		peer = defaultPeerConfig()
+	})
+
+	return &harness{
+		browserDERP: browserDERP.Public(),
+		serverConn:  serverConn,
+		serverWG:    serverPriv,
+		browserWG:   browserPub,
+	}
+}
+
+// startServer brings up the peer and serves "hello" on port 80.
+func (h *harness) startServer(t *testing.T) error {
+	bind := wgbind.NewDerpBind(h.serverConn, h.browserDERP)
+	srvTun, err := tunnel.New(tunnel.Config{
+		LocalIP:    peer.peerIP.String(),
+		PrivateKey: h.serverWG,
+		Peer: tunnel.PeerConfig{
+			PublicKey:  h.browserWG,
+			AllowedIPs: []string{peer.localIP.String() + "/32"},
+		},
+		Bind: bind,
+	})
+	if err != nil {
+		return err
+	}
+	t.Cleanup(func() { srvTun.Close() })
+
+	ln, err := srvTun.ListenTCP(80)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return nil
+}
+
+// newWireGuardKeys returns a fresh WireGuard key pair, hex.
+func newWireGuardKeys(t *testing.T) (priv, pub string) {
+	t.Helper()
+	priv, err := keys.NewWireGuardPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = keys.WireGuardPublicKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestFetchHTTPWaitsForHandshake(t *testing.T) {
+	h := newHarness(t)
+
+	// The server shows up after fetchHTTP has been called
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(time.Second)
+		if err := h.startServer(t); err != nil {
+			t.Errorf("server: %v", err)
+		}
+	}()
+	defer func() { <-started }()
+
+	resp := fetchHTTP(js.Undefined(), nil).(map[string]interface{})
+	if resp["success"] != true {
+		t.Fatalf("fetchHTTP failed: %v", resp["error"])
+	}
+	if resp["body"] != "hello" {
+		t.Errorf("body = %q, want %q", resp["body"], "hello")
+	}
+}
+
+func TestFetchHTTPStillConnecting(t *testing.T) {
+	newHarness(t)
+
+	old := handshakeTimeout
+	handshakeTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { handshakeTimeout = old })
+
+	start := time.Now()
+	resp := fetchHTTP(js.Undefined(), nil).(map[string]interface{})
+	elapsed := time.Since(start)
+
+	if resp["success"] != false {
+		t.Fatal("fetchHTTP succeeded without a peer")
+	}
+	if msg, _ := resp["error"].(string); !strings.Contains(msg, "still connecting") {
+		t.Errorf("error = %q, want a \"still connecting\" error", msg)
+	}
+	if elapsed < handshakeTimeout {
+		t.Errorf("fetchHTTP gave up after %s, before the %s timeout", elapsed, handshakeTimeout)
+	}
+}
+
+func TestValidateDERPURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string // "" if valid
+	}{
+		{"https://derp.example.com/derp", ""},
+		{"http://localhost:3340/derp", ""},
+		{"https://derp.example.com/custom/path", ""},
+		{"wss://derp.example.com/derp", "scheme must be https or http"},
+		{"ftp://derp.example.com/derp", "scheme must be https or http"},
+		{"derp.example.com/derp", "scheme must be https or http"},
+		{"https:///derp", "missing host"},
+		{"https://", "missing host"},
+		{"https://derp example.com", "invalid DERP URL"},
+	}
+	for _, tt := range tests {
+		err := validateDERPURL(tt.url)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("validateDERPURL(%q) = %v, want valid", tt.url, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("validateDERPURL(%q) = %v, want an error containing %q", tt.url, err, tt.wantErr)
+		}
+	}
+}
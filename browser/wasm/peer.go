@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall/js"
+
+	"github.com/drio/spanza/keys"
+)
+
+// peerConfig describes the tunnel: who the peer is and our addresses.
+type peerConfig struct {
+	derpPublic string     // Peer's DERP public key ("nodekey:...")
+	wgPublic   string     // Peer's WireGuard public key, hex
+	wgPrivate  string     // Our WireGuard private key, hex
+	localIP    netip.Addr // Our address inside the tunnel
+	peerIP     netip.Addr // The peer's address inside the tunnel
+}
+
+// defaultPeerConfig is the browser/server example's peer.
+func defaultPeerConfig() peerConfig {
+	return peerConfig{
+		derpPublic: serverDERPPublic,
+		wgPublic:   serverWGPublic,
+		wgPrivate:  browserWGPrivate,
+		localIP:    netip.MustParseAddr(browserIP),
+		peerIP:     netip.MustParseAddr(serverIP),
+	}
+}
+
+// parsePeerConfig reads the peer options of createWireGuard, falling back to
+// defaultPeerConfig for any that are missing:
+//
+//	createWireGuard({
+//	    peerDERPPublicKey: "nodekey:...",
+//	    peerWGPublicKey:   "...",          // hex or base64
+//	    wgPrivateKey:      "...",          // ours, hex or base64
+//	    localIP:           "192.168.4.2",
+//	    peerIP:            "192.168.4.1",
+//	})
+//
+// Every field is checked and all problems are reported together, before
+// anything is created.
+func parsePeerConfig(opts js.Value) (peerConfig, error) {
+	cfg := defaultPeerConfig()
+	if opts.Type() != js.TypeObject {
+		return cfg, nil
+	}
+
+	var errs []error
+	if v, ok := stringOption(opts, "peerDERPPublicKey"); ok {
+		if pub, err := keys.ParseNodePublic(v); err != nil {
+			errs = append(errs, fmt.Errorf("peerDERPPublicKey: %w", err))
+		} else {
+			cfg.derpPublic = pub.String()
+		}
+	}
+	if v, ok := stringOption(opts, "peerWGPublicKey"); ok {
+		if h, err := keys.WireGuardKeyHex(v); err != nil {
+			errs = append(errs, fmt.Errorf("peerWGPublicKey: %w", err))
+		} else {
+			cfg.wgPublic = h
+		}
+	}
+	if v, ok := stringOption(opts, "wgPrivateKey"); ok {
+		if h, err := keys.WireGuardKeyHex(v); err != nil {
+			errs = append(errs, fmt.Errorf("wgPrivateKey: %w", err))
+		} else {
+			cfg.wgPrivate = h
+		}
+	}
+	if v, ok := stringOption(opts, "localIP"); ok {
+		if ip, err := netip.ParseAddr(v); err != nil {
+			errs = append(errs, fmt.Errorf("localIP: %w", err))
+		} else {
+			cfg.localIP = ip
+		}
+	}
+	if v, ok := stringOption(opts, "peerIP"); ok {
+		if ip, err := netip.ParseAddr(v); err != nil {
+			errs = append(errs, fmt.Errorf("peerIP: %w", err))
+		} else {
+			cfg.peerIP = ip
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return peerConfig{}, err
+	}
+	if cfg.localIP == cfg.peerIP {
+		return peerConfig{}, fmt.Errorf("localIP and peerIP are both %s", cfg.localIP)
+	}
+	if wgPub, err := keys.WireGuardPublicKey(cfg.wgPrivate); err == nil && wgPub == cfg.wgPublic {
+		return peerConfig{}, errors.New("peerWGPublicKey is our own WireGuard public key")
+	}
+	return cfg, nil
+}
+
+// stringOption returns opts[name] if it is a non-empty string.
+func stringOption(opts js.Value, name string) (string, bool) {
+	v := opts.Get(name)
+	if v.Type() != js.TypeString || v.String() == "" {
+		return "", false
+	}
+	return v.String(), true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"syscall/js"
+	"testing"
+
+	"github.com/drio/spanza/keys"
+	"tailscale.com/types/key"
+)
+
+func TestParsePeerConfigDefaults(t *testing.T) {
+	for _, opts := range []js.Value{js.Undefined(), js.Null(), js.ValueOf(map[string]any{})} {
+		cfg, err := parsePeerConfig(opts)
+		if err != nil {
+			t.Fatalf("%v: %v", opts, err)
+		}
+		if cfg != defaultPeerConfig() {
+			t.Errorf("%v: got %+v, want the defaults", opts, cfg)
+		}
+	}
+}
+
+func TestParsePeerConfig(t *testing.T) {
+	peerDERP := key.NewNode().Public()
+	wgPriv, err := keys.NewWireGuardPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgPub, _ := keys.WireGuardPublicKey(wgPriv)
+	wgPubBase64, _ := keys.WireGuardKeyBase64(wgPub)
+
+	cfg, err := parsePeerConfig(js.ValueOf(map[string]any{
+		"peerDERPPublicKey": peerDERP.String(),
+		"peerWGPublicKey":   wgPubBase64, // Normalized to hex
+		"localIP":           "10.0.0.2",
+		"peerIP":            "10.0.0.1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.derpPublic != peerDERP.String() || cfg.wgPublic != wgPub {
+		t.Errorf("peer keys = %s, %s, want %s, %s", cfg.derpPublic, cfg.wgPublic, peerDERP, wgPub)
+	}
+	if cfg.localIP.String() != "10.0.0.2" || cfg.peerIP.String() != "10.0.0.1" {
+		t.Errorf("IPs = %s, %s", cfg.localIP, cfg.peerIP)
+	}
+	if cfg.wgPrivate != browserWGPrivate {
+		t.Errorf("our WireGuard key changed without wgPrivateKey")
+	}
+}
+
+func TestParsePeerConfigErrors(t *testing.T) {
+	ownWGPub, _ := keys.WireGuardPublicKey(browserWGPrivate)
+
+	tests := []struct {
+		name string
+		opts map[string]any
+		want []string
+	}{
+		{
+			name: "every field malformed",
+			opts: map[string]any{
+				"peerDERPPublicKey": "privkey:00",
+				"peerWGPublicKey":   "short",
+				"wgPrivateKey":      "also short",
+				"localIP":           "10.0.0",
+				"peerIP":            "nowhere",
+			},
+			want: []string{"peerDERPPublicKey", "peerWGPublicKey", "wgPrivateKey", "localIP", "peerIP"},
+		},
+		{
+			name: "same IPs",
+			opts: map[string]any{"localIP": "10.0.0.1", "peerIP": "10.0.0.1"},
+			want: []string{"both 10.0.0.1"},
+		},
+		{
+			name: "our own WireGuard key",
+			opts: map[string]any{"peerWGPublicKey": ownWGPub},
+			want: []string{"our own"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePeerConfig(js.ValueOf(tt.opts))
+			if err == nil {
+				t.Fatal("invalid options accepted")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error doesn't mention %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Command wgkeygen generates the two key pairs a spanza peer needs: a DERP
+// node key pair (relay identity) and a WireGuard key pair (tunnel
+// encryption).
+//
+// The WireGuard keys are printed both hex encoded, as IpcSet expects, and
+// base64 encoded, as wg(8) and wg-quick use. With -o all four keys are also
+// written to a JSON file.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/drio/spanza/keys"
+	"tailscale.com/types/key"
+)
+
+var outFile = flag.String("o", "", "Also write the keys to this JSON file (mode 0600)")
+
+// keyFile is the JSON written by -o. The WireGuard keys are hex, so they can
+// go straight into IpcSet.
+type keyFile struct {
+	DERPPrivateKey string `json:"derp_private_key"`
+	DERPPublicKey  string `json:"derp_public_key"`
+	WGPrivateKey   string `json:"wg_private_key"`
+	WGPublicKey    string `json:"wg_public_key"`
+}
+
+func main() {
+	flag.Parse()
+
+	derpPriv := key.NewNode()
+	derpPrivText, err := derpPriv.MarshalText()
+	if err != nil {
+		log.Fatalf("Failed to encode DERP private key: %v", err)
+	}
+
+	wgPriv, err := keys.NewWireGuardPrivate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	wgPub, err := keys.WireGuardPublicKey(wgPriv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	kf := keyFile{
+		DERPPrivateKey: string(derpPrivText),
+		DERPPublicKey:  derpPriv.Public().String(),
+		WGPrivateKey:   wgPriv,
+		WGPublicKey:    wgPub,
+	}
+
+	// Hex was just produced by us, so the conversions can't fail
+	wgPrivB64, _ := keys.WireGuardKeyBase64(wgPriv)
+	wgPubB64, _ := keys.WireGuardKeyBase64(wgPub)
+
+	fmt.Printf("DERP private key:               %s\n", kf.DERPPrivateKey)
+	fmt.Printf("DERP public key:                %s\n", kf.DERPPublicKey)
+	fmt.Printf("WireGuard private key (hex):    %s\n", wgPriv)
+	fmt.Printf("WireGuard private key (base64): %s\n", wgPrivB64)
+	fmt.Printf("WireGuard public key (hex):     %s\n", wgPub)
+	fmt.Printf("WireGuard public key (base64):  %s\n", wgPubB64)
+
+	if *outFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode keys: %v", err)
+	}
+	data = append(data, '\n')
+
+	if err := os.WriteFile(*outFile, data, 0600); err != nil {
+		log.Fatalf("Failed to write %s: %v", *outFile, err)
+	}
+	fmt.Printf("✓ Keys written to %s\n", *outFile)
+}
@@ -0,0 +1,83 @@
+// Package frame implements the length-prefixed framing used to carry
+// WireGuard packets over stream transports (raw TCP, HTTP Upgrade, WebSocket).
+//
+// A stream has no packet boundaries, so each packet is sent as a frame:
+//
+//	+----------------------+------------------+
+//	| length (4 bytes, BE) | payload (length) |
+//	+----------------------+------------------+
+//
+// Readers and writers may return partial data at any point (TCP segmentation,
+// TLS records, ...). ReadFrame and WriteFrame keep going until a whole frame
+// has been transferred.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// HeaderSize is the size of the length prefix.
+const HeaderSize = 4
+
+// MaxFrameSize is the largest payload accepted. WireGuard packets travel in
+// UDP datagrams, so they can never be larger than this. The guard stops a
+// corrupt or malicious length prefix from making us allocate gigabytes.
+const MaxFrameSize = 65535
+
+// ErrFrameTooLarge is returned for payloads larger than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("frame: frame too large")
+
+// WriteFrame writes p to w as a single frame.
+//
+// The header and payload go out in one buffer so a frame is never
+// interleaved with another writer's data at the Write level. Short writes
+// are retried until the whole frame is written.
+func WriteFrame(w io.Writer, p []byte) error {
+	if len(p) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, HeaderSize+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[HeaderSize:], p)
+
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// A writer making no progress without an error would loop forever
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// ReadFrame reads the next frame from r and returns its payload.
+//
+// It returns io.EOF if the stream ends cleanly between frames, and
+// io.ErrUnexpectedEOF if it ends in the middle of one.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [HeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	p := make([]byte, size)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,216 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// shortWriter accepts at most n bytes per Write.
+type shortWriter struct {
+	w io.Writer
+	n int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	return s.w.Write(p)
+}
+
+// stuckWriter accepts nothing and reports no error.
+type stuckWriter struct{}
+
+func (stuckWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestWriteFrameShortWrites(t *testing.T) {
+	var buf bytes.Buffer
+	payload := []byte("a WireGuard packet")
+	if err := WriteFrame(&shortWriter{w: &buf, n: 3}, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	want := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	want = append(want, payload...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wrote %x, want %x", buf.Bytes(), want)
+	}
+}
+
+func TestWriteFrameNoProgress(t *testing.T) {
+	if err := WriteFrame(stuckWriter{}, []byte("x")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("err = %v, want io.ErrShortWrite", err)
+	}
+}
+
+func TestReadFramePartialReads(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, MaxFrameSize)}
+	for _, p := range payloads {
+		if err := WriteFrame(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One byte per Read, headers and payloads split everywhere
+	r := iotest.OneByteReader(&buf)
+	for i, want := range payloads {
+		got, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: err = %v, want io.EOF", err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	if err := WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("WriteFrame: err = %v, want ErrFrameTooLarge", err)
+	}
+
+	// A corrupt length prefix must not make ReadFrame allocate or wait for
+	// the payload
+	hdr := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+	if _, err := ReadFrame(bytes.NewReader(hdr)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame: err = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameEOF(t *testing.T) {
+	var frame bytes.Buffer
+	if err := WriteFrame(&frame, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	full := frame.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty stream", nil, io.EOF},
+		{"mid header", full[:2], io.ErrUnexpectedEOF},
+		{"after header", full[:HeaderSize], io.ErrUnexpectedEOF},
+		{"mid payload", full[:HeaderSize+3], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadFrame(bytes.NewReader(tt.data)); err != tt.want {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// oneByteConn is a stream endpoint at its most fragmented: every Write
+// takes a single byte and every Read returns a single byte, like TCP
+// segmenting a frame at every possible boundary. What is written can be
+// read back; once closed, reads fail with io.EOF after the buffered bytes.
+type oneByteConn struct {
+	buf    bytes.Buffer
+	closed bool
+}
+
+var _ io.ReadWriteCloser = (*oneByteConn)(nil)
+
+func (c *oneByteConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return c.buf.Write(p[:1])
+}
+
+func (c *oneByteConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.buf.Read(p[:1])
+}
+
+func (c *oneByteConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFramesOverOneByteConn(t *testing.T) {
+	conn := &oneByteConn{}
+	payloads := [][]byte{
+		[]byte("handshake"),
+		{},
+		bytes.Repeat([]byte{0x5a}, 1500),
+		bytes.Repeat([]byte{0xab}, MaxFrameSize),
+	}
+	for i, p := range payloads {
+		if err := WriteFrame(conn, p); err != nil {
+			t.Fatalf("write frame %d: %v", i, err)
+		}
+	}
+
+	// An oversized frame is refused without writing anything, so the
+	// stream stays in sync
+	before := conn.buf.Len()
+	if err := WriteFrame(conn, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized frame: err = %v, want ErrFrameTooLarge", err)
+	}
+	if conn.buf.Len() != before {
+		t.Errorf("oversized frame wrote %d bytes", conn.buf.Len()-before)
+	}
+	conn.Close()
+
+	for i, want := range payloads {
+		got, err := ReadFrame(conn)
+		if err != nil {
+			t.Fatalf("read frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d: got %d bytes, want %d intact", i, len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(conn); err != io.EOF {
+		t.Errorf("closed after the last frame: err = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameOneByteConnErrors(t *testing.T) {
+	var frame bytes.Buffer
+	if err := WriteFrame(&frame, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	full := frame.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"closed before a frame", nil, io.EOF},
+		{"closed mid header", full[:3], io.ErrUnexpectedEOF},
+		{"closed mid payload", full[:len(full)-1], io.ErrUnexpectedEOF},
+		{"oversized length", binary.BigEndian.AppendUint32(nil, MaxFrameSize+1), ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &oneByteConn{}
+			conn.buf.Write(tt.data)
+			conn.Close()
+			if _, err := ReadFrame(conn); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// fileConfig is the JSON form of a Config.
+type fileConfig struct {
+	Prefix         string   `json:"prefix"`
+	DerpURL        string   `json:"derp_url"`
+	PrivKey        string   `json:"priv_key"`
+	RemotePubKey   string   `json:"remote_pub_key"`
+	WGEndpoint     string   `json:"wg_endpoint"`
+	AllowedSources []string `json:"allowed_sources"`
+	Verbose        bool     `json:"verbose"`
+}
+
+func (fc fileConfig) config() Config {
+	return Config{
+		Prefix:          fc.Prefix,
+		DerpURL:         fc.DerpURL,
+		PrivKeyStr:      fc.PrivKey,
+		RemotePubKeyStr: fc.RemotePubKey,
+		WGEndpoint:      fc.WGEndpoint,
+		AllowedSources:  fc.AllowedSources,
+		Verbose:         fc.Verbose,
+	}
+}
+
+// LoadConfig reads a single gateway configuration from a JSON file:
+//
+//	{
+//	  "prefix": "[peer1-gw]",
+//	  "derp_url": "https://derp.tailscale.com/derp",
+//	  "priv_key": "privkey:...",
+//	  "remote_pub_key": "nodekey:...",
+//	  "wg_endpoint": "127.0.0.1:51820",
+//	  "verbose": false
+//	}
+//
+// The configuration is validated (see Config.Validate) before it is
+// returned, so mistakes show up when loading rather than inside Run.
+func LoadConfig(path string) (Config, error) {
+	cfgs, err := LoadConfigs(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if len(cfgs) != 1 {
+		return Config{}, fmt.Errorf("%s: expected one gateway, found %d", path, len(cfgs))
+	}
+	return cfgs[0], nil
+}
+
+// LoadConfigs reads the configuration of one or more gateways from a JSON
+// file holding either a single object (see LoadConfig) or a list of them,
+// for launching several gateways together. Every entry is validated, and
+// all problems are reported at once.
+func LoadConfigs(path string) ([]Config, error) {
+	// #nosec G304 - path is chosen by the operator
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fcs []fileConfig
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = decodeStrict(data, &fcs)
+	} else {
+		var fc fileConfig
+		err = decodeStrict(data, &fc)
+		fcs = []fileConfig{fc}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	cfgs := make([]Config, 0, len(fcs))
+	for i, fc := range fcs {
+		cfg := fc.config()
+		if err := cfg.Validate(); err != nil {
+			name := cfg.Prefix
+			if name == "" {
+				name = fmt.Sprintf("gateway %d", i+1)
+			}
+			errs = append(errs, fmt.Errorf("%s:\n%w", name, err))
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%s: invalid configuration:\n%w", path, err)
+	}
+	return cfgs, nil
+}
+
+// decodeStrict decodes JSON, rejecting unknown fields so a misspelled key
+// is an error instead of a silently empty setting.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
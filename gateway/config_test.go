@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/key"
+)
+
+// writeConfig writes data to a config file in a temporary directory.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// gatewayJSON returns a valid JSON gateway configuration named prefix.
+func gatewayJSON(prefix string) string {
+	priv, _ := key.NewNode().MarshalText()
+	return fmt.Sprintf(`{
+		"prefix": %q,
+		"derp_url": "https://derp.example.com/derp",
+		"priv_key": %q,
+		"remote_pub_key": %q,
+		"wg_endpoint": "127.0.0.1:51820"
+	}`, prefix, priv, testPeer.String())
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, gatewayJSON("[gw]")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Prefix != "[gw]" || cfg.RemotePubKeyStr != testPeer.String() || cfg.WGEndpoint != "127.0.0.1:51820" {
+		t.Errorf("loaded %+v", cfg)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	data := strings.Replace(gatewayJSON("[gw]"), `"wg_endpoint"`, `"wg_endpiont"`, 1)
+	_, err := LoadConfig(writeConfig(t, data))
+	if err == nil || !strings.Contains(err.Error(), "wg_endpiont") {
+		t.Errorf("err = %v, want an error about the unknown field", err)
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	path := writeConfig(t, "["+gatewayJSON("[gw1]")+","+gatewayJSON("[gw2]")+"]")
+
+	cfgs, err := LoadConfigs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfgs) != 2 || cfgs[0].Prefix != "[gw1]" || cfgs[1].Prefix != "[gw2]" {
+		t.Errorf("loaded %+v, want [gw1] and [gw2]", cfgs)
+	}
+
+	// A list file is not a single gateway
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "expected one gateway") {
+		t.Errorf("LoadConfig: err = %v, want an error about the gateway count", err)
+	}
+}
+
+func TestLoadConfigsReportsEveryGateway(t *testing.T) {
+	bad1 := strings.Replace(gatewayJSON("[gw1]"), "https://", "ftp://", 1)
+	bad2 := strings.Replace(gatewayJSON("[gw2]"), "127.0.0.1:51820", "127.0.0.1:notaport", 1)
+	path := writeConfig(t, "["+bad1+","+gatewayJSON("[ok]")+","+bad2+"]")
+
+	_, err := LoadConfigs(path)
+	if err == nil {
+		t.Fatal("LoadConfigs accepted broken gateways")
+	}
+	for _, want := range []string{"[gw1]", "invalid DERP URL", "[gw2]", "invalid WireGuard endpoint"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "[ok]") {
+		t.Errorf("error mentions the valid gateway:\n%v", err)
+	}
+}
@@ -2,10 +2,18 @@ package gateway
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/logging"
+	"github.com/drio/spanza/wgbind"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/netmon"
@@ -20,6 +28,58 @@ type UDPConn interface {
 	Close() error
 }
 
+// DERPClient is the part of a DERP client that the gateway uses.
+// *derphttp.Client satisfies it.
+type DERPClient interface {
+	Send(dstKey key.NodePublic, b []byte) error
+	Recv() (derp.ReceivedMessage, error)
+	Close() error
+}
+
+var _ DERPClient = (*derphttp.Client)(nil)
+
+// derpConnector is implemented by DERP clients that can be told to
+// (re)connect explicitly, like *derphttp.Client.
+type derpConnector interface {
+	Connect(ctx context.Context) error
+}
+
+var _ derpConnector = (*derphttp.Client)(nil)
+
+// Backoff between DERP reconnection attempts after repeated receive errors.
+const (
+	minRecvBackoff = time.Second
+	maxRecvBackoff = 30 * time.Second
+)
+
+// RecvBackoff returns how long a DERP receive loop should wait after the
+// given number of consecutive receive errors: nothing after the first,
+// then doubling from one second, capped at 30 seconds.
+func RecvBackoff(failures int) time.Duration {
+	backoff := minRecvBackoff
+	for i := 2; i < failures && backoff < maxRecvBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRecvBackoff)
+}
+
+// SessionGap is how long the remote peer may be silent before its session
+// counts as over (see Status). WireGuard drops session keys after 180s
+// (RejectAfterTime) and rekeys well before that while traffic flows, so an
+// active peer is never silent for this long and each rekey doesn't restart
+// the session.
+const SessionGap = 180 * time.Second
+
+// drainQuiet is how long the DERP → UDP direction must be idle before a
+// drain considers the in-flight packets delivered.
+const drainQuiet = 250 * time.Millisecond
+
+// readDeadliner is implemented by UDP connections whose blocked reads can be
+// interrupted without closing them, like *net.UDPConn and *gonet.UDPConn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
 // Config holds the configuration for a Spanza gateway.
 type Config struct {
 	// Prefix is used for logging (e.g., "[gateway]", "[peer1-gw]")
@@ -30,11 +90,147 @@ type Config struct {
 	PrivKeyStr      string // This peer's DERP private key (e.g., "privkey:...")
 	RemotePubKeyStr string // Remote peer's DERP public key (e.g., "nodekey:...")
 
-	// WireGuard endpoint to forward received DERP packets to
+	// Optional: TLS settings for the DERP connection created from DerpURL,
+	// e.g. a client certificate. See wgbind.CheckDERPTLSConfig for what
+	// can't be set.
+	TLSConfig *tls.Config
+
+	// Optional: an existing DERP client to use instead of creating one from
+	// DerpURL and PrivKeyStr (which are then ignored), e.g. one the caller
+	// connected up front. The gateway takes it over: it consumes every
+	// message the client receives, so it must not have another reader, and
+	// Stop closes it to interrupt the blocked Recv.
+	DerpClient DERPClient
+
+	// WireGuard endpoint to forward received DERP packets to.
+	// If empty, it is learned from the source of WireGuard handshake packets
+	// arriving on the UDP connection; DERP packets received before the first
+	// handshake are dropped.
 	WGEndpoint string // e.g., "127.0.0.1:51820"
 
-	// Optional: enable verbose logging
+	// Optional: DERP public keys ("nodekey:...") allowed to send to our
+	// WireGuard endpoint. Packets from any other source are dropped.
+	// Empty allows every source, as anyone on the DERP server who knows our
+	// public key can send to us.
+	AllowedSources []string
+
+	// Optional: on Stop, stop reading from WireGuard and give the packets
+	// already in flight up to this long to get through before closing the
+	// connections (0 closes right away). See Gateway.Stop.
+	DrainTimeout time.Duration
+
+	// Optional: enable verbose logging (debug level output of the default
+	// logger; ignored when Logger is set)
 	Verbose bool
+
+	// Optional: where to log. Defaults to the standard log package with
+	// Prefix in front of each line.
+	Logger logging.Logger
+
+	// Optional: called after each packet is forwarded, with event "DERP sent"
+	// (from WireGuard to the remote peer) or "UDP sent" (from DERP to
+	// WireGuard), e.g. to log packets in a structured format. It runs on the
+	// forwarding path, so it must not block.
+	OnForward func(event, src, dst string, data []byte)
+}
+
+// Validate checks the whole configuration and returns every problem found,
+// joined into a single error, so they can all be fixed in one go.
+// It only checks the configuration itself, it does not contact DERP.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	var privKey key.NodePrivate
+	if cfg.DerpClient == nil {
+		if u, err := url.Parse(cfg.DerpURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DERP URL: %w", err))
+		} else if u.Scheme != "https" && u.Scheme != "http" {
+			errs = append(errs, fmt.Errorf("invalid DERP URL %q: scheme must be https or http", cfg.DerpURL))
+		}
+
+		var err error
+		if privKey, err = keys.ParseNodePrivate(cfg.PrivKeyStr); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := wgbind.CheckDERPTLSConfig(cfg.TLSConfig); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if remotePubKey, err := keys.ParseNodePublic(cfg.RemotePubKeyStr); err != nil {
+		errs = append(errs, fmt.Errorf("remote peer: %w", err))
+	} else if !privKey.IsZero() && privKey.Public() == remotePubKey {
+		errs = append(errs, errors.New("remote public key is our own DERP public key"))
+	}
+
+	for _, src := range cfg.AllowedSources {
+		if _, err := keys.ParseNodePublic(src); err != nil {
+			errs = append(errs, fmt.Errorf("allowed source: %w", err))
+		}
+	}
+
+	if cfg.WGEndpoint != "" {
+		if _, err := net.ResolveUDPAddr("udp", cfg.WGEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid WireGuard endpoint: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Gateway forwards packets between a UDP connection (facing WireGuard) and
+// DERP. Use Start and Stop to manage it, or Run to block until a context
+// is cancelled.
+type Gateway struct {
+	cfg     Config
+	udpConn UDPConn
+	prefix  string
+	logger  logging.Logger
+
+	remotePubKey  key.NodePublic
+	allowed       map[key.NodePublic]bool // Sources allowed to reach WireGuard (nil = everyone)
+	rejected      atomic.Uint64           // Packets dropped by AllowedSources
+	learnEndpoint bool
+	wgAddr        atomic.Value // net.Addr, where to send received DERP packets
+	lastRecv      atomic.Int64 // Unix nanos of the last packet from DERP, for draining
+	sessionStart  atomic.Int64 // Unix nanos the peer's current session started
+
+	packetsToDERP   atomic.Uint64
+	packetsFromDERP atomic.Uint64
+	derpConnected   atomic.Bool // Last DERP receive succeeded
+
+	derpClient DERPClient
+
+	cancel     context.CancelFunc // Stops UDP → DERP
+	recvCancel context.CancelFunc // Stops DERP → UDP, after draining
+	udpDone    chan struct{}
+	derpDone   chan struct{}
+	started    atomic.Bool
+	stopOnce   sync.Once
+}
+
+// New creates a gateway forwarding between udpConn and DERP. It does
+// nothing until Start is called.
+func New(cfg Config, udpConn UDPConn) *Gateway {
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "[gateway]"
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = logging.Std(prefix, cfg.Verbose)
+	}
+
+	return &Gateway{
+		cfg:      cfg,
+		udpConn:  udpConn,
+		prefix:   prefix,
+		logger:   logger,
+		udpDone:  make(chan struct{}),
+		derpDone: make(chan struct{}),
+	}
 }
 
 // Run starts a Spanza gateway that forwards packets between UDP and DERP.
@@ -43,134 +239,381 @@ type Config struct {
 //  1. UDP → DERP: Reads packets from udpConn, sends to remote peer via DERP
 //  2. DERP → UDP: Receives packets from DERP, writes to WireGuard endpoint via udpConn
 //
-// The function blocks until ctx is cancelled.
+// The function blocks until ctx is cancelled and the gateway has stopped
+// (see Stop).
 func Run(ctx context.Context, cfg Config, udpConn UDPConn) error {
-	prefix := cfg.Prefix
-	if prefix == "" {
-		prefix = "[gateway]"
+	g := New(cfg, udpConn)
+	if err := g.Start(ctx); err != nil {
+		return err
 	}
 
-	log.Printf("%s Starting Spanza gateway (UDP ↔ DERP)...", prefix)
+	<-ctx.Done()
+	g.Stop()
+	return nil
+}
 
-	// Parse DERP private key
-	var privKey key.NodePrivate
-	if err := privKey.UnmarshalText([]byte(cfg.PrivKeyStr)); err != nil {
-		return fmt.Errorf("%s failed to parse private key: %w", prefix, err)
+// Start checks the configuration, sets up the DERP client and starts
+// forwarding in the background. The gateway runs until Stop is called or
+// ctx is cancelled, which stops it the same way (call Stop anyway to wait
+// for it to finish). A Gateway can only be started once.
+func (g *Gateway) Start(ctx context.Context) error {
+	if !g.started.CompareAndSwap(false, true) {
+		return fmt.Errorf("%s gateway already started", g.prefix)
 	}
 
-	// Parse remote peer's DERP public key
-	var remotePubKey key.NodePublic
-	if err := remotePubKey.UnmarshalText([]byte(cfg.RemotePubKeyStr)); err != nil {
-		return fmt.Errorf("%s failed to parse remote public key: %w", prefix, err)
-	}
+	cfg := g.cfg
+	g.logger.Infof("Starting Spanza gateway (UDP ↔ DERP)...")
 
-	if cfg.Verbose {
-		log.Printf("%s Will send to remote DERP key: %s", prefix, remotePubKey.ShortString())
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%s invalid configuration: %w", g.prefix, err)
 	}
 
-	// Resolve WireGuard endpoint (where to send received DERP packets)
-	wgAddr, err := net.ResolveUDPAddr("udp", cfg.WGEndpoint)
+	// Parse remote peer's DERP public key
+	remotePubKey, err := keys.ParseNodePublic(cfg.RemotePubKeyStr)
 	if err != nil {
-		return fmt.Errorf("%s invalid WireGuard endpoint: %w", prefix, err)
+		return fmt.Errorf("%s failed to parse remote public key: %w", g.prefix, err)
 	}
+	g.remotePubKey = remotePubKey
 
-	// Create DERP client
-	netMon := netmon.NewStatic()
-	logf := func(format string, args ...any) {
-		if cfg.Verbose {
-			log.Printf("[derp] "+format, args...)
+	g.logger.Debugf("Will send to remote DERP key: %s", remotePubKey.ShortString())
+
+	// Sources allowed to reach WireGuard (nil = everyone)
+	if len(cfg.AllowedSources) > 0 {
+		g.allowed = make(map[key.NodePublic]bool, len(cfg.AllowedSources))
+		for _, src := range cfg.AllowedSources {
+			k, err := keys.ParseNodePublic(src)
+			if err != nil {
+				return fmt.Errorf("%s invalid allowed source: %w", g.prefix, err)
+			}
+			g.allowed[k] = true
 		}
 	}
 
-	derpClient, err := derphttp.NewClient(privKey, cfg.DerpURL, logf, netMon)
-	if err != nil {
-		return fmt.Errorf("%s failed to create DERP client: %w", prefix, err)
+	// Resolve WireGuard endpoint (where to send received DERP packets),
+	// or learn it from the first handshake
+	g.learnEndpoint = cfg.WGEndpoint == ""
+	if g.learnEndpoint {
+		g.logger.Infof("No WireGuard endpoint configured, waiting for a handshake to learn it")
+	} else {
+		addr, err := net.ResolveUDPAddr("udp", cfg.WGEndpoint)
+		if err != nil {
+			return fmt.Errorf("%s invalid WireGuard endpoint: %w", g.prefix, err)
+		}
+		g.wgAddr.Store(net.Addr(addr))
+	}
+
+	// Use the caller's DERP client, or create our own
+	g.derpClient = cfg.DerpClient
+	if g.derpClient == nil {
+		g.derpClient, err = newDERPClient(cfg, g.logger)
+		if err != nil {
+			return fmt.Errorf("%s %w", g.prefix, err)
+		}
+
+		g.logger.Infof("DERP client created (connection will happen automatically)")
+	} else {
+		g.logger.Infof("Using provided DERP client")
 	}
-	defer derpClient.Close()
 
-	log.Printf("%s DERP client created (connection will happen automatically)", prefix)
-	log.Printf("%s Gateway ready (UDP ↔ DERP)", prefix)
+	// The DERP → UDP direction gets its own context: it keeps delivering
+	// replies while Stop drains
+	ctx, g.cancel = context.WithCancel(ctx)
+	recvCtx, recvCancel := context.WithCancel(context.Background())
+	g.recvCancel = recvCancel
 
-	// Close connections when context is cancelled
-	// This will wake up any blocked ReadFrom/Recv calls cleanly
+	// Stop (and drain) when ctx is cancelled
 	go func() {
 		<-ctx.Done()
-		udpConn.Close()
-		derpClient.Close() // This will interrupt the blocking Recv() call
+		g.Stop()
 	}()
 
-	// Goroutine: UDP → DERP
-	// Read packets from WireGuard, send to DERP
 	go func() {
-		buf := make([]byte, 65535)
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
+		defer close(g.udpDone)
+		g.udpToDERP(ctx)
+	}()
+	go func() {
+		defer close(g.derpDone)
+		g.derpToUDP(recvCtx)
+	}()
 
-			n, _, err := udpConn.ReadFrom(buf)
-			if err != nil {
-				// Connection closed (context cancellation closes udpConn)
-				return
-			}
+	g.logger.Infof("Gateway ready (UDP ↔ DERP)")
+	return nil
+}
 
-			if cfg.Verbose {
-				log.Printf("%s → Received %d bytes in the UDP connection, sending to DERP", prefix, n)
-			}
+// Stop shuts the gateway down and waits for its goroutines to exit.
+//
+// With Config.DrainTimeout set, it first drains: it stops reading from
+// WireGuard, lets the DERP send in progress finish and keeps delivering
+// packets from DERP until none has arrived for a moment (or the timeout
+// expires), so the replies to the last packets aren't dropped. Only then are
+// the connections closed, which wakes up any blocked ReadFrom/Recv. The
+// DERP client is closed too, even one given in Config.DerpClient.
+func (g *Gateway) Stop() {
+	g.stopOnce.Do(func() {
+		g.logger.Infof("Gateway shutting down")
+		if g.cancel == nil {
+			return // Never started
+		}
+		g.cancel() // udpToDERP takes no new packets
+
+		if g.cfg.DrainTimeout > 0 {
+			g.drain(g.cfg.DrainTimeout)
+		}
+
+		g.recvCancel()
+		g.udpConn.Close()
+		g.derpClient.Close() // This will interrupt the blocking Recv() call
+
+		<-g.udpDone
+		<-g.derpDone
+	})
+}
 
-			// Send to remote peer via DERP
-			if err := derpClient.Send(remotePubKey, buf[:n]); err != nil {
-				log.Printf("%s DERP send error: %v", prefix, err)
-			} else if cfg.Verbose {
-				log.Printf("%s ✓ Sent %d bytes to remote peer via DERP", prefix, n)
+// Rejected returns the number of packets from DERP dropped because their
+// source isn't in Config.AllowedSources.
+func (g *Gateway) Rejected() uint64 {
+	return g.rejected.Load()
+}
+
+// Status is a snapshot of a gateway's state, for status endpoints.
+type Status struct {
+	DERPConnected   bool      // The last DERP receive succeeded
+	PacketsToDERP   uint64    // Sent from WireGuard to the remote peer
+	PacketsFromDERP uint64    // Received from DERP for WireGuard
+	LastRecv        time.Time // Last packet from DERP, zero if none yet
+	SessionStart    time.Time // Start of the peer's current session, zero if it's down
+}
+
+// Status returns the gateway's current state. The peer's session starts
+// with its first packet and lasts until it has been silent for SessionGap.
+func (g *Gateway) Status() Status {
+	st := Status{
+		DERPConnected:   g.derpConnected.Load(),
+		PacketsToDERP:   g.packetsToDERP.Load(),
+		PacketsFromDERP: g.packetsFromDERP.Load(),
+	}
+	if last := g.lastRecv.Load(); last != 0 {
+		st.LastRecv = time.Unix(0, last)
+		if time.Since(st.LastRecv) <= SessionGap {
+			st.SessionStart = time.Unix(0, g.sessionStart.Load())
+		}
+	}
+	return st
+}
+
+// notePeerPacket records a packet from the peer at now, starting a new
+// session if the peer had been silent for longer than SessionGap.
+func (g *Gateway) notePeerPacket(now time.Time) {
+	n := now.UnixNano()
+	if last := g.lastRecv.Swap(n); last == 0 || time.Duration(n-last) > SessionGap {
+		g.sessionStart.Store(n)
+	}
+}
+
+// drain waits up to timeout for the packets in flight to get through: first
+// for udpToDERP to finish its current DERP send, then for the DERP → UDP
+// direction to be quiet for drainQuiet.
+func (g *Gateway) drain(timeout time.Duration) {
+	g.logger.Infof("Draining in-flight packets (up to %s)...", timeout)
+	deadline := time.Now().Add(timeout)
+
+	// Wake up the blocked UDP read; udpToDERP sees the cancelled context and
+	// returns after its current DERP send completes. A connection without
+	// read deadlines stays blocked until it is closed, but drops whatever it
+	// reads from now on.
+	if d, ok := g.udpConn.(readDeadliner); ok {
+		if err := d.SetReadDeadline(time.Now()); err != nil {
+			g.logger.Errorf("Failed to stop UDP reads: %v", err)
+		}
+
+		select {
+		case <-g.udpDone:
+		case <-time.After(time.Until(deadline)):
+			g.logger.Errorf("Drain timed out waiting for DERP sends")
+			return
+		}
+	}
+
+	for time.Now().Before(deadline) {
+		if time.Since(time.Unix(0, g.lastRecv.Load())) >= drainQuiet {
+			g.logger.Infof("Drain complete")
+			return
+		}
+		time.Sleep(drainQuiet / 5)
+	}
+	g.logger.Errorf("Drain timed out waiting for DERP receives")
+}
+
+// udpToDERP reads packets from WireGuard and sends them to DERP, until the
+// UDP connection is closed.
+func (g *Gateway) udpToDERP(ctx context.Context) {
+	buf := make([]byte, 65535)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		n, addr, err := g.udpConn.ReadFrom(buf)
+		if err != nil {
+			// Connection closed or read deadline hit (see Stop)
+			return
+		}
+		if ctx.Err() != nil {
+			return // Stopping, take no new packets
+		}
+
+		// Only handshakes teach us the endpoint, so stray traffic can't
+		// redirect it. Following every handshake also tracks WireGuard
+		// restarting on a new port.
+		if g.learnEndpoint && isHandshake(buf[:n]) {
+			if prev, _ := g.wgAddr.Load().(net.Addr); prev == nil || prev.String() != addr.String() {
+				g.logger.Infof("Learned WireGuard endpoint %s from handshake", addr)
+				g.wgAddr.Store(addr)
 			}
 		}
-	}()
 
-	// Goroutine: DERP → UDP
-	// Receive packets from DERP, send to WireGuard
-	go func() {
-		log.Printf("%s DERP receive loop started", prefix)
-		for {
-			select {
-			case <-ctx.Done():
-				log.Printf("%s DERP receive loop exiting (context done)", prefix)
-				return
-			default:
+		g.logger.Debugf("→ Received %d bytes in the UDP connection, sending to DERP", n)
+
+		// Send to remote peer via DERP
+		if err := g.derpClient.Send(g.remotePubKey, buf[:n]); err != nil {
+			g.logger.Errorf("DERP send error: %v", err)
+		} else {
+			g.packetsToDERP.Add(1)
+			g.logger.Debugf("✓ Sent %d bytes to remote peer via DERP", n)
+			if g.cfg.OnForward != nil {
+				g.cfg.OnForward("DERP sent", addr.String(), g.remotePubKey.ShortString(), buf[:n])
 			}
+		}
+	}
+}
 
-			log.Printf("%s Waiting for DERP message...", prefix)
-			msg, err := derpClient.Recv()
-			if err != nil {
-				if ctx.Err() != nil {
-					log.Printf("%s DERP receive loop exiting (context error)", prefix)
+// derpToUDP receives packets from DERP and writes them to WireGuard, until
+// ctx is cancelled (after draining, see Stop).
+func (g *Gateway) derpToUDP(ctx context.Context) {
+	logger := g.logger
+	logger.Infof("DERP receive loop started")
+	failures := 0 // Consecutive Recv errors
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf("DERP receive loop exiting (context done)")
+			return
+		default:
+		}
+
+		logger.Debugf("Waiting for DERP message...")
+		msg, err := g.derpClient.Recv()
+		// Recv may have been blocked since before Stop: don't forward
+		// anything once stopped
+		if ctx.Err() != nil {
+			logger.Debugf("DERP receive loop exiting (context done)")
+			return
+		}
+		if err != nil {
+			g.derpConnected.Store(false)
+			logger.Errorf("DERP recv error: %v", err)
+
+			// A dead connection fails every Recv right away, so back
+			// off instead of spinning, then try to reconnect
+			failures++
+			if failures > 1 {
+				backoff := RecvBackoff(failures)
+				logger.Errorf("DERP failed %d times in a row, reconnecting in %s", failures, backoff)
+				select {
+				case <-ctx.Done():
+					logger.Debugf("DERP receive loop exiting (context done)")
 					return
+				case <-time.After(backoff):
+				}
+			}
+			if c, ok := g.derpClient.(derpConnector); ok {
+				if err := c.Connect(ctx); err != nil {
+					logger.Errorf("DERP reconnect failed: %v", err)
 				}
-				log.Printf("%s DERP recv error: %v", prefix, err)
-				continue
 			}
+			continue
+		}
+		g.derpConnected.Store(true)
+		if failures > 0 {
+			logger.Infof("DERP connection recovered after %d errors", failures)
+			failures = 0
+		}
 
-			log.Printf("%s Received DERP message type: %T", prefix, msg)
-			// Only handle received packets
-			switch m := msg.(type) {
-			case derp.ReceivedPacket:
-				if cfg.Verbose {
-					log.Printf("%s ← Received %d bytes from DERP, writing to UDP connection", prefix, len(m.Data))
+		logger.Debugf("Received DERP message type: %T", msg)
+		// Only handle received packets
+		switch m := msg.(type) {
+		case derp.ReceivedPacket:
+			if g.allowed != nil && !g.allowed[m.Source] {
+				rejected := g.rejected.Add(1)
+				if rejected == 1 {
+					logger.Errorf("WARNING: Dropping packets from disallowed sources, first from %s", m.Source.ShortString())
 				}
+				logger.Debugf("Dropped packet from disallowed source %s (%d dropped so far)", m.Source.ShortString(), rejected)
+				continue
+			}
+
+			logger.Debugf("← Received %d bytes from DERP, writing to UDP connection", len(m.Data))
+			g.notePeerPacket(time.Now())
+			g.packetsFromDERP.Add(1)
 
-				_, err := udpConn.WriteTo(m.Data, wgAddr)
-				if err != nil {
-					log.Printf("%s UDP write error: %v", prefix, err)
-				} else if cfg.Verbose {
-					log.Printf("%s ✓ Wrote %d bytes to UDP connection", prefix, len(m.Data))
+			dst, _ := g.wgAddr.Load().(net.Addr)
+			if dst == nil {
+				logger.Debugf("Dropping %d bytes from DERP, WireGuard endpoint not learned yet", len(m.Data))
+				continue
+			}
+
+			_, err := g.udpConn.WriteTo(m.Data, dst)
+			if err != nil {
+				logger.Errorf("UDP write error: %v", err)
+			} else {
+				logger.Debugf("✓ Wrote %d bytes to UDP connection", len(m.Data))
+				if g.cfg.OnForward != nil {
+					g.cfg.OnForward("UDP sent", m.Source.ShortString(), dst.String(), m.Data)
 				}
 			}
+
+		case derp.ServerInfoMessage:
+			if m.TokenBucketBytesPerSecond > 0 {
+				logger.Infof("DERP rate limit: %d bytes/s (burst %d)", m.TokenBucketBytesPerSecond, m.TokenBucketBytesBurst)
+			}
+
+		case derp.HealthMessage:
+			if m.Problem != "" {
+				logger.Errorf("WARNING: DERP server unhealthy: %s", m.Problem)
+			} else {
+				logger.Infof("DERP server healthy again")
+			}
+
+		case derp.ServerRestartingMessage:
+			logger.Errorf("WARNING: DERP server restarting (reconnect in %s, retry for %s)", m.ReconnectIn, m.TryFor)
+
+		case derp.PeerGoneMessage:
+			logger.Infof("Peer %s gone from DERP server (reason %v)", m.Peer.ShortString(), m.Reason)
+
+		default:
+			logger.Debugf("Ignoring DERP message type %T", msg)
 		}
-	}()
+	}
+}
 
-	<-ctx.Done()
-	log.Printf("%s Gateway shutting down", prefix)
-	return nil
+// newDERPClient creates a DERP client from the configured URL and private key.
+func newDERPClient(cfg Config, logger logging.Logger) (*derphttp.Client, error) {
+	privKey, err := keys.ParseNodePrivate(cfg.PrivKeyStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	netMon := netmon.NewStatic()
+	logf := func(format string, args ...any) {
+		logger.Debugf("[derp] "+format, args...)
+	}
+
+	client, err := derphttp.NewClient(privKey, cfg.DerpURL, logf, netMon)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DERP client: %w", err)
+	}
+	client.TLSConfig = cfg.TLSConfig
+	return client, nil
 }
@@ -0,0 +1,471 @@
+package gateway
+
+import (
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// nopLogger keeps the gateway quiet in tests.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
+
+// events records what the fakes did, in order.
+type events struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *events) add(ev string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, ev)
+}
+
+func (e *events) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.list)
+}
+
+// udpPacket is a packet read from or written to a fakeUDPConn.
+type udpPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// fakeUDPConn is the WireGuard side of the gateway: packets pushed into in
+// are read by the gateway, the gateway's writes land in out.
+type fakeUDPConn struct {
+	events *events
+	in     chan udpPacket
+	out    chan udpPacket
+
+	mu       sync.Mutex
+	closed   chan struct{}
+	deadline chan struct{} // Closed when the read deadline is set to the past
+}
+
+func newFakeUDPConn(ev *events) *fakeUDPConn {
+	return &fakeUDPConn{
+		events:   ev,
+		in:       make(chan udpPacket, 16),
+		out:      make(chan udpPacket, 16),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+	}
+}
+
+func (c *fakeUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.deadline:
+		return 0, nil, os.ErrDeadlineExceeded
+	case pkt := <-c.in:
+		return copy(b, pkt.data), pkt.addr, nil
+	}
+}
+
+func (c *fakeUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.events.add("udp write " + string(b))
+	c.out <- udpPacket{data: append([]byte(nil), b...), addr: addr}
+	return len(b), nil
+}
+
+func (c *fakeUDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !t.After(time.Now()) {
+		select {
+		case <-c.deadline:
+		default:
+			close(c.deadline)
+		}
+	}
+	return nil
+}
+
+func (c *fakeUDPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		c.events.add("udp close")
+		close(c.closed)
+	}
+	return nil
+}
+
+// fakeDERPClient is the DERP side of the gateway: messages pushed into recv
+// are received by the gateway, its sends land in sent. Sends block while
+// block is non-nil, until it is closed.
+type fakeDERPClient struct {
+	events *events
+	recv   chan derp.ReceivedMessage
+	sent   chan []byte
+
+	block   chan struct{}
+	sending chan struct{} // Signaled when a send starts
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeDERPClient(ev *events) *fakeDERPClient {
+	return &fakeDERPClient{
+		events:  ev,
+		recv:    make(chan derp.ReceivedMessage, 16),
+		sent:    make(chan []byte, 16),
+		sending: make(chan struct{}, 16),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *fakeDERPClient) Send(dstKey key.NodePublic, b []byte) error {
+	c.sending <- struct{}{}
+	if c.block != nil {
+		<-c.block
+	}
+	c.events.add("derp send " + string(b))
+	c.sent <- append([]byte(nil), b...)
+	return nil
+}
+
+func (c *fakeDERPClient) Recv() (derp.ReceivedMessage, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case msg := <-c.recv:
+		return msg, nil
+	}
+}
+
+func (c *fakeDERPClient) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+var (
+	testPeer     = key.NewNode().Public()
+	testEndpoint = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820}
+)
+
+// testConfig is a valid configuration using client.
+func testConfig(client DERPClient) Config {
+	return Config{
+		RemotePubKeyStr: testPeer.String(),
+		DerpClient:      client,
+		WGEndpoint:      testEndpoint.String(),
+		Logger:          nopLogger{},
+	}
+}
+
+func TestStopDrainsInFlightPackets(t *testing.T) {
+	ev := &events{}
+	udp := newFakeUDPConn(ev)
+	client := newFakeDERPClient(ev)
+	client.block = make(chan struct{})
+	defer client.Close()
+
+	cfg := testConfig(client)
+	cfg.DrainTimeout = 5 * time.Second
+	g := New(cfg, udp)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A packet from WireGuard is on its way to DERP when Stop is called
+	udp.in <- udpPacket{data: []byte("request"), addr: testEndpoint}
+	<-client.sending
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+
+	// The reply comes back from DERP while the send is still blocked
+	client.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("reply")}
+	<-udp.out
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with a DERP send in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(client.block)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+
+	want := []string{"udp write reply", "derp send request", "udp close"}
+	if got := ev.get(); !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestStopWithoutDrainClosesRightAway(t *testing.T) {
+	ev := &events{}
+	udp := newFakeUDPConn(ev)
+	client := newFakeDERPClient(ev)
+	defer client.Close()
+
+	g := New(testConfig(client), udp)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	g.Stop()
+	if elapsed := time.Since(start); elapsed > drainQuiet {
+		t.Errorf("Stop took %s without a drain timeout", elapsed)
+	}
+	if got, want := ev.get(), []string{"udp close"}; !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Config{
+		DerpURL:         "ftp://derp.example.com",
+		PrivKeyStr:      "privkey:nothex",
+		RemotePubKeyStr: "nodekey:nothex",
+		AllowedSources:  []string{"privkey:00"},
+		WGEndpoint:      "127.0.0.1:notaport",
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted a broken configuration")
+	}
+	for _, want := range []string{
+		"invalid DERP URL",
+		"invalid DERP private key",
+		"remote peer: invalid DERP public key",
+		"allowed source:",
+		"invalid WireGuard endpoint",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateOwnKey(t *testing.T) {
+	priv := key.NewNode()
+	privText, _ := priv.MarshalText()
+	cfg := Config{
+		DerpURL:         "https://derp.example.com/derp",
+		PrivKeyStr:      string(privText),
+		RemotePubKeyStr: priv.Public().String(),
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "our own") {
+		t.Errorf("err = %v, want an error about our own key", err)
+	}
+}
+
+// handshakeInitiation returns a packet shaped like a WireGuard handshake
+// initiation (see isHandshake).
+func handshakeInitiation() []byte {
+	pkt := make([]byte, wgHandshakeInitiationSize)
+	pkt[0] = wgHandshakeInitiation
+	return pkt
+}
+
+func TestLearnEndpointFromHandshake(t *testing.T) {
+	ev := &events{}
+	udp := newFakeUDPConn(ev)
+	client := newFakeDERPClient(ev)
+	defer client.Close()
+
+	cfg := testConfig(client)
+	cfg.WGEndpoint = "" // Learn it
+	g := New(cfg, udp)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	// Stray traffic arrives first, then WireGuard's handshake
+	junkAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	udp.in <- udpPacket{data: []byte("junk"), addr: junkAddr}
+	<-client.sent
+	udp.in <- udpPacket{data: handshakeInitiation(), addr: testEndpoint}
+	<-client.sent
+
+	client.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("reply")}
+	select {
+	case pkt := <-udp.out:
+		if pkt.addr.String() != testEndpoint.String() {
+			t.Errorf("reply written to %s, want the handshake's source %s", pkt.addr, testEndpoint)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not written to UDP")
+	}
+}
+
+func TestAllowedSources(t *testing.T) {
+	ev := &events{}
+	udp := newFakeUDPConn(ev)
+	client := newFakeDERPClient(ev)
+	defer client.Close()
+
+	cfg := testConfig(client)
+	cfg.AllowedSources = []string{testPeer.String()}
+	g := New(cfg, udp)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	stranger := key.NewNode().Public()
+	client.recv <- derp.ReceivedPacket{Source: stranger, Data: []byte("disallowed")}
+	client.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("allowed")}
+
+	select {
+	case pkt := <-udp.out:
+		if string(pkt.data) != "allowed" {
+			t.Errorf("wrote %q to UDP, want only %q", pkt.data, "allowed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed packet not written to UDP")
+	}
+	if got := g.Rejected(); got != 1 {
+		t.Errorf("Rejected = %d, want 1", got)
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	ev := &events{}
+	client := newFakeDERPClient(ev)
+	defer client.Close()
+
+	g := New(testConfig(client), newFakeUDPConn(ev))
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	if err := g.Start(t.Context()); err == nil || !strings.Contains(err.Error(), "already started") {
+		t.Errorf("second Start: err = %v, want an error", err)
+	}
+}
+
+func TestStopWaitsForProvidedClient(t *testing.T) {
+	ev := &events{}
+	client := newFakeDERPClient(ev)
+
+	g := New(testConfig(client), newFakeUDPConn(ev))
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		g.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't return")
+	}
+
+	// Both loops are gone, the receive loop because Stop closed the client
+	for name, done := range map[string]chan struct{}{"UDP → DERP": g.udpDone, "DERP → UDP": g.derpDone} {
+		select {
+		case <-done:
+		default:
+			t.Errorf("Stop returned before the %s loop exited", name)
+		}
+	}
+	select {
+	case <-client.closed:
+	default:
+		t.Error("provided DERP client not closed")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ev := &events{}
+	udp := newFakeUDPConn(ev)
+	client := newFakeDERPClient(ev)
+	defer client.Close()
+
+	var forwarded events
+	cfg := testConfig(client)
+	cfg.OnForward = func(event, src, dst string, data []byte) {
+		forwarded.add(event + " " + string(data))
+	}
+	g := New(cfg, udp)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	if st := g.Status(); st.DERPConnected || !st.LastRecv.IsZero() || !st.SessionStart.IsZero() {
+		t.Errorf("status before any traffic = %+v, want disconnected and no session", st)
+	}
+
+	udp.in <- udpPacket{data: []byte("request"), addr: testEndpoint}
+	<-client.sent
+	client.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("reply")}
+	<-udp.out
+
+	st := g.Status()
+	if !st.DERPConnected || st.PacketsToDERP != 1 || st.PacketsFromDERP != 1 {
+		t.Errorf("status = %+v, want connected with one packet each way", st)
+	}
+	if st.SessionStart.IsZero() || st.SessionStart != st.LastRecv {
+		t.Errorf("session started at %v, want the first packet's time %v", st.SessionStart, st.LastRecv)
+	}
+	want := []string{"DERP sent request", "UDP sent reply"}
+	if got := forwarded.get(); !slices.Equal(got, want) {
+		t.Errorf("OnForward got %q, want %q", got, want)
+	}
+}
+
+func TestSessionStart(t *testing.T) {
+	g := New(testConfig(nil), nil)
+
+	// A session that started 10s ago and is still going
+	now := time.Now()
+	g.notePeerPacket(now.Add(-10 * time.Second))
+	g.notePeerPacket(now)
+	if start := g.Status().SessionStart; !start.Equal(now.Add(-10 * time.Second)) {
+		t.Errorf("session started at %v, want 10s ago", start)
+	}
+
+	// Silent for longer than SessionGap: the session is over, and the next
+	// packet starts a new one
+	g.lastRecv.Store(now.Add(-SessionGap - time.Second).UnixNano())
+	if st := g.Status(); !st.SessionStart.IsZero() || st.LastRecv.IsZero() {
+		t.Errorf("status after a long silence = %+v, want the session over", st)
+	}
+	g.notePeerPacket(now)
+	if start := g.Status().SessionStart; !start.Equal(now) {
+		t.Errorf("session started at %v, want the new packet's time", start)
+	}
+}
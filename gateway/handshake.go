@@ -0,0 +1,27 @@
+package gateway
+
+import "encoding/binary"
+
+// WireGuard handshake message types and their exact sizes on the wire.
+const (
+	wgHandshakeInitiation     = 1
+	wgHandshakeResponse       = 2
+	wgHandshakeInitiationSize = 148
+	wgHandshakeResponseSize   = 92
+)
+
+// isHandshake reports whether b looks like a WireGuard handshake initiation
+// or response: the right message type, three zero reserved bytes, and the
+// exact size for that type. Stray UDP traffic practically never matches.
+func isHandshake(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(b[:4]) {
+	case wgHandshakeInitiation:
+		return len(b) == wgHandshakeInitiationSize
+	case wgHandshakeResponse:
+		return len(b) == wgHandshakeResponseSize
+	}
+	return false
+}
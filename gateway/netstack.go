@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+var _ UDPConn = (*gonet.UDPConn)(nil)
+
+// ListenNetstackUDP opens a UDP listener inside a userspace network stack,
+// for running a gateway where kernel sockets aren't available (WASM and
+// similar setups). addr is "host:port"; an empty host listens on all
+// addresses of the stack.
+func ListenNetstackUDP(tnet *netstack.Net, addr string) (UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+
+	udpConn, err := tnet.ListenUDP(udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s in netstack: %w", addr, err)
+	}
+	return udpConn, nil
+}
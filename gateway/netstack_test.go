@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"tailscale.com/derp"
+)
+
+func TestNetstackGateway(t *testing.T) {
+	_, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.1.0.1")}, nil, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpConn, err := ListenNetstackUDP(tnet, ":51821")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatewayAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 51821}
+
+	// WireGuard's side, in the same network stack
+	wgAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 51820}
+	wg, err := tnet.ListenUDP(wgAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+
+	client := newFakeDERPClient(&events{})
+	cfg := testConfig(client)
+	cfg.WGEndpoint = wgAddr.String()
+	g := New(cfg, udpConn)
+	if err := g.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+
+	// WireGuard → DERP
+	if _, err := wg.WriteTo([]byte("request"), gatewayAddr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-client.sent:
+		if string(data) != "request" {
+			t.Errorf("sent %q to DERP, want %q", data, "request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet from WireGuard not sent to DERP")
+	}
+
+	// DERP → WireGuard
+	client.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("reply")}
+	wg.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := wg.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("packet from DERP not written to WireGuard: %v", err)
+	}
+	if string(buf[:n]) != "reply" || from.String() != gatewayAddr.String() {
+		t.Errorf("WireGuard got %q from %s, want %q from %s", buf[:n], from, "reply", gatewayAddr)
+	}
+}
+
+func TestListenNetstackUDPInvalidAddress(t *testing.T) {
+	_, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.1.0.1")}, nil, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenNetstackUDP(tnet, "10.1.0.1:notaport"); err == nil {
+		t.Error("ListenNetstackUDP accepted an invalid address")
+	}
+}
@@ -0,0 +1,178 @@
+// Package keys parses, converts and validates the key material used by
+// spanza programs.
+//
+// There are two independent key pairs per peer:
+//   - DERP node keys ("privkey:..." / "nodekey:..."), used for relay identity/addressing
+//   - WireGuard keys (hex encoded, as IpcSet expects), used for tunnel encryption.
+//     wg(8) and wg-quick print them base64 encoded instead.
+//
+// The examples hardcode both halves of each pair, and a copy-paste mistake
+// doesn't fail anywhere, the handshake just never completes. These helpers
+// derive the public key from the private one so mismatches fail at startup.
+package keys
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"tailscale.com/types/key"
+)
+
+// WireGuardPublicKey derives the hex encoded WireGuard public key for a hex
+// encoded private key.
+func WireGuardPublicKey(privHex string) (string, error) {
+	raw, err := hex.DecodeString(privHex)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard private key: %w", err)
+	}
+
+	// WireGuard keys are Curve25519 (X25519) keys
+	priv, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard private key: %w", err)
+	}
+	return hex.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+// NewWireGuardPrivate generates a WireGuard private key, hex encoded.
+func NewWireGuardPrivate() (string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate WireGuard key: %w", err)
+	}
+	return hex.EncodeToString(priv.Bytes()), nil
+}
+
+// CheckWireGuardPair returns an error if pub is not the public key of priv.
+// Both may be hex (in either case) or base64, see WireGuardKeyHex.
+func CheckWireGuardPair(priv, pub string) error {
+	privHex, err := WireGuardKeyHex(priv)
+	if err != nil {
+		return fmt.Errorf("WireGuard private key: %w", err)
+	}
+	pubHex, err := WireGuardKeyHex(pub)
+	if err != nil {
+		return fmt.Errorf("WireGuard public key: %w", err)
+	}
+
+	derived, err := WireGuardPublicKey(privHex)
+	if err != nil {
+		return err
+	}
+	if derived != pubHex {
+		return fmt.Errorf("WireGuard public key %s does not match its private key (derived %s)", pub, derived)
+	}
+	return nil
+}
+
+// CheckDERPPair returns an error if pubStr ("nodekey:...") is not the public
+// key of privStr ("privkey:...").
+func CheckDERPPair(privStr, pubStr string) error {
+	priv, err := ParseNodePrivate(privStr)
+	if err != nil {
+		return err
+	}
+
+	pub, err := ParseNodePublic(pubStr)
+	if err != nil {
+		return err
+	}
+
+	if derived := priv.Public(); derived != pub {
+		return fmt.Errorf("DERP public key %s does not match its private key (derived %s)", pub, derived)
+	}
+	return nil
+}
+
+// DERP key prefixes, as used by key.NodePrivate/key.NodePublic text encoding.
+const (
+	nodePrivatePrefix = "privkey:"
+	nodePublicPrefix  = "nodekey:"
+)
+
+// ParseNodePrivate parses a DERP private key, either "privkey:<hex>" or just
+// the hex part. Surrounding whitespace (e.g. a trailing newline from a key
+// file) is ignored.
+func ParseNodePrivate(s string) (key.NodePrivate, error) {
+	text, err := withPrefix(s, nodePrivatePrefix)
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("invalid DERP private key: %w", err)
+	}
+
+	var priv key.NodePrivate
+	if err := priv.UnmarshalText([]byte(text)); err != nil {
+		return key.NodePrivate{}, fmt.Errorf("invalid DERP private key: %w", err)
+	}
+	return priv, nil
+}
+
+// ParseNodePublic parses a DERP public key, either "nodekey:<hex>" or just
+// the hex part. Surrounding whitespace is ignored.
+func ParseNodePublic(s string) (key.NodePublic, error) {
+	text, err := withPrefix(s, nodePublicPrefix)
+	if err != nil {
+		return key.NodePublic{}, fmt.Errorf("invalid DERP public key: %w", err)
+	}
+
+	var pub key.NodePublic
+	if err := pub.UnmarshalText([]byte(text)); err != nil {
+		return key.NodePublic{}, fmt.Errorf("invalid DERP public key: %w", err)
+	}
+	return pub, nil
+}
+
+// withPrefix trims s and adds prefix if it has none. A different prefix
+// (say a "privkey:" where a "nodekey:" belongs) is an error.
+func withPrefix(s, prefix string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	if strings.HasPrefix(s, prefix) {
+		return s, nil
+	}
+	if other, _, ok := strings.Cut(s, ":"); ok {
+		return "", fmt.Errorf("expected %q prefix, got %q", prefix, other+":")
+	}
+	return prefix + s, nil
+}
+
+// WireGuardKeyHex normalizes a WireGuard key (private or public) to the hex
+// encoding IpcSet expects. It accepts hex or the base64 encoding used by
+// wg(8) and wg-quick.
+func WireGuardKeyHex(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	var raw []byte
+	var err error
+	switch len(s) {
+	case hex.EncodedLen(wireGuardKeySize):
+		raw, err = hex.DecodeString(s)
+	case base64.StdEncoding.EncodedLen(wireGuardKeySize):
+		raw, err = base64.StdEncoding.DecodeString(s)
+	default:
+		return "", fmt.Errorf("invalid WireGuard key: expected 64 hex or 44 base64 characters, got %d", len(s))
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid WireGuard key: %w", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// WireGuardKeyBase64 converts a WireGuard key (hex or base64) to the base64
+// encoding used by wg(8) and wg-quick.
+func WireGuardKeyBase64(s string) (string, error) {
+	h, err := WireGuardKeyHex(s)
+	if err != nil {
+		return "", err
+	}
+	raw, _ := hex.DecodeString(h) // Just normalized, can't fail
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// wireGuardKeySize is the size of a Curve25519 key.
+const wireGuardKeySize = 32
@@ -0,0 +1,228 @@
+package keys
+
+import (
+	"strings"
+	"testing"
+)
+
+// The example keys used throughout the repo (bench/, userspace/, container/)
+const (
+	peer1DERPPrivate = "privkey:a85c6983dd4e96c1e54aed78a21b3e50f26bd2786cbddfb6d01cdd77673bda7d"
+	peer1DERPPublic  = "nodekey:4b115ea75d1aeb08d489d9b9015f4b8228a60e1cfe4e231332e29bc4da71f659"
+	peer2DERPPublic  = "nodekey:e3603e7b1d8024bad24da4c413b5989211c4f8e5ead29660f05addaa454e810b"
+
+	peer1WGPrivate = "087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379"
+	peer1WGPublic  = "f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c"
+	peer2WGPublic  = "c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28"
+)
+
+func TestCheckWireGuardPair(t *testing.T) {
+	if err := CheckWireGuardPair(peer1WGPrivate, peer1WGPublic); err != nil {
+		t.Errorf("matching pair: %v", err)
+	}
+
+	err := CheckWireGuardPair(peer1WGPrivate, peer2WGPublic)
+	if err == nil {
+		t.Fatal("mismatched pair: no error")
+	}
+	if !strings.Contains(err.Error(), "does not match") || !strings.Contains(err.Error(), peer1WGPublic) {
+		t.Errorf("mismatched pair: error %q doesn't name the derived key", err)
+	}
+}
+
+func TestCheckDERPPair(t *testing.T) {
+	if err := CheckDERPPair(peer1DERPPrivate, peer1DERPPublic); err != nil {
+		t.Errorf("matching pair: %v", err)
+	}
+
+	err := CheckDERPPair(peer1DERPPrivate, peer2DERPPublic)
+	if err == nil {
+		t.Fatal("mismatched pair: no error")
+	}
+	if !strings.Contains(err.Error(), "does not match") || !strings.Contains(err.Error(), peer1DERPPublic) {
+		t.Errorf("mismatched pair: error %q doesn't name the derived key", err)
+	}
+}
+
+// The example WireGuard keys above, base64 encoded as wg(8) prints them
+const (
+	peer1WGPrivateBase64 = "CH7G4Uu+0hDnIVzcc0aN+iPwgKG/uGZbL9gJvZnSg3k="
+	peer1WGPublicBase64  = "+SjU9sG4bBLyViwQsHxVXFxX/QD1npDI2NiHZyccv3w="
+)
+
+func TestWireGuardPublicKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		priv    string
+		want    string
+		wantErr bool
+	}{
+		{"example key", peer1WGPrivate, peer1WGPublic, false},
+		{"upper case hex", strings.ToUpper(peer1WGPrivate), peer1WGPublic, false},
+		{"not hex", "not a key", "", true},
+		{"too short", peer1WGPrivate[:62], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WireGuardPublicKey(tt.priv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Generated keys derive too
+	priv, err := NewWireGuardPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WireGuardPublicKey(priv); err != nil {
+		t.Errorf("generated key: %v", err)
+	}
+}
+
+func TestCheckWireGuardPairEncodings(t *testing.T) {
+	tests := []struct {
+		name      string
+		priv, pub string
+		wantErr   bool
+	}{
+		{"hex", peer1WGPrivate, peer1WGPublic, false},
+		{"upper case hex", strings.ToUpper(peer1WGPrivate), strings.ToUpper(peer1WGPublic), false},
+		{"base64", peer1WGPrivateBase64, peer1WGPublicBase64, false},
+		{"mixed", peer1WGPrivate, peer1WGPublicBase64, false},
+		{"surrounding whitespace", peer1WGPrivate + "\n", " " + peer1WGPublic, false},
+		{"mismatch", peer1WGPrivateBase64, peer2WGPublic, true},
+		{"invalid private key", "nothex", peer1WGPublic, true},
+		{"invalid public key", peer1WGPrivate, "nothex", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckWireGuardPair(tt.priv, tt.pub)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWireGuardKeyHex(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"hex", peer1WGPublic, peer1WGPublic, false},
+		{"upper case hex", strings.ToUpper(peer1WGPublic), peer1WGPublic, false},
+		{"base64", peer1WGPublicBase64, peer1WGPublic, false},
+		{"wrong length", peer1WGPublic + "00", "", true},
+		{"bad hex", strings.Repeat("zz", 32), "", true},
+		{"bad base64", strings.Repeat("!", 44), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WireGuardKeyHex(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// And back
+	if got, err := WireGuardKeyBase64(peer1WGPublic); err != nil || got != peer1WGPublicBase64 {
+		t.Errorf("WireGuardKeyBase64 = %s, %v, want %s", got, err, peer1WGPublicBase64)
+	}
+}
+
+func TestParseNodeKeys(t *testing.T) {
+	privHex := strings.TrimPrefix(peer1DERPPrivate, "privkey:")
+	pubHex := strings.TrimPrefix(peer1DERPPublic, "nodekey:")
+
+	privTests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"with prefix", peer1DERPPrivate, ""},
+		{"without prefix", privHex, ""},
+		{"surrounding whitespace", " " + peer1DERPPrivate + "\n", ""},
+		{"wrong prefix", "nodekey:" + privHex, `expected "privkey:" prefix, got "nodekey:"`},
+		{"empty", "  ", "empty key"},
+		{"bad hex", "privkey:nothex", "invalid DERP private key"},
+	}
+	for _, tt := range privTests {
+		t.Run("private/"+tt.name, func(t *testing.T) {
+			priv, err := ParseNodePrivate(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := priv.Public().String(); got != peer1DERPPublic {
+				t.Errorf("public key = %s, want %s", got, peer1DERPPublic)
+			}
+		})
+	}
+
+	pubTests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"with prefix", peer1DERPPublic, ""},
+		{"without prefix", pubHex, ""},
+		{"surrounding whitespace", peer1DERPPublic + "\n", ""},
+		{"wrong prefix", "privkey:" + pubHex, `expected "nodekey:" prefix, got "privkey:"`},
+		{"empty", "", "empty key"},
+		{"bad hex", "nodekey:nothex", "invalid DERP public key"},
+	}
+	for _, tt := range pubTests {
+		t.Run("public/"+tt.name, func(t *testing.T) {
+			pub, err := ParseNodePublic(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pub.String(); got != peer1DERPPublic {
+				t.Errorf("got %s, want %s", got, peer1DERPPublic)
+			}
+		})
+	}
+}
+
+func TestCheckDERPPairForms(t *testing.T) {
+	tests := []struct {
+		name      string
+		priv, pub string
+		wantErr   bool
+	}{
+		{"prefixed", peer1DERPPrivate, peer1DERPPublic, false},
+		{"bare hex", strings.TrimPrefix(peer1DERPPrivate, "privkey:"), strings.TrimPrefix(peer1DERPPublic, "nodekey:"), false},
+		{"mismatch", peer1DERPPrivate, peer2DERPPublic, true},
+		{"swapped", peer1DERPPublic, peer1DERPPrivate, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDERPPair(tt.priv, tt.pub)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
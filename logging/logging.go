@@ -0,0 +1,43 @@
+// Package logging defines the leveled logger used by the gateway and
+// wgbind packages, so programs embedding them can route or silence their
+// output.
+package logging
+
+import "log"
+
+// Logger logs at three levels. Debug is per-packet and per-iteration
+// detail, Info is connection state changes, Error is failures and warnings.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// Std returns a Logger writing to the standard log package, with prefix
+// (e.g. "[gateway]") in front of each line. Debug output is only written
+// when debug is true.
+func Std(prefix string, debug bool) Logger {
+	if prefix != "" {
+		prefix += " "
+	}
+	return stdLogger{prefix: prefix, debug: debug}
+}
+
+type stdLogger struct {
+	prefix string
+	debug  bool
+}
+
+func (l stdLogger) Debugf(format string, args ...any) {
+	if l.debug {
+		log.Printf(l.prefix+format, args...)
+	}
+}
+
+func (l stdLogger) Infof(format string, args ...any) {
+	log.Printf(l.prefix+format, args...)
+}
+
+func (l stdLogger) Errorf(format string, args ...any) {
+	log.Printf(l.prefix+format, args...)
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"tailscale.com/derp"
+	"github.com/drio/spanza/gateway"
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/logging"
+	"github.com/drio/spanza/wgbind"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/netmon"
 	"tailscale.com/types/key"
@@ -21,6 +29,7 @@ const version = "0.2.0-derp"
 
 var (
 	derpURL = flag.String("derp-url", "https://derp.tailscale.com/derp", "DERP server URL")
+	derpMap = flag.String("derp-map", "", "Tailscale-style DERP map JSON file; use its nearest region instead of --derp-url")
 	// DERP key is separate from WireGuard key - used only for DERP identity/addressing.
 	// Could use WG key instead (like Tailscale does), but keeping separate for cleaner separation.
 	keyFile    = flag.String("key-file", "", "Path to private key file (will generate if missing)")
@@ -29,23 +38,26 @@ var (
 	wgEndpoint  = flag.String("wg-endpoint", "127.0.0.1:51820", "Local WireGuard endpoint (IP:port)")
 	listenAddr  = flag.String("listen", ":51821", "UDP listen address for WireGuard")
 	verbose     = flag.Bool("verbose", false, "Enable verbose logging")
+	logFormat   = flag.String("log-format", "text", "Log format: text or json (one JSON object per line)")
 	showVersion = flag.Bool("version", false, "Show version and exit")
 	showPubkey  = flag.Bool("show-pubkey", false, "Show DERP public key and exit")
+	check       = flag.Bool("check", false, "Validate the configuration and DERP connectivity, then exit (0 if OK)")
+	// On SIGTERM/SIGINT stop reading UDP and give in-flight packets this long to get through
+	drainTimeout = flag.Duration("drain-timeout", 5*time.Second, "Grace period to drain in-flight packets on shutdown (0 disables)")
+	statusListen = flag.String("status-listen", "", "HTTP address for the status, health (/healthz) and readiness (/readyz) endpoints, e.g. 127.0.0.1:8080 (empty disables)")
 )
 
-// Gateway handles UDP <-> DERP translation
-type Gateway struct {
-	derpClient    *derphttp.Client
-	privateKey    key.NodePrivate
-	udpConn       *net.UDPConn
-	remotePeerKey key.NodePublic
-	wgAddr        *net.UDPAddr
-	ctx           context.Context
-}
-
 func main() {
 	flag.Parse()
 
+	switch *logFormat {
+	case "text":
+	case "json":
+		setupJSONLogging(os.Stderr)
+	default:
+		log.Fatalf("Invalid --log-format %q (want text or json)", *logFormat)
+	}
+
 	if *showVersion {
 		fmt.Printf("spanza %s - WireGuard to DERP gateway\n", version)
 		return
@@ -60,90 +72,132 @@ func main() {
 		return
 	}
 
-	if *remotePeer == "" {
-		log.Fatal("--remote-peer is required")
-	}
+	// Check every input up front and report all problems at once,
+	// rather than making the user fix them one crash at a time
+	var errs []error
 
 	var remotePeerKey key.NodePublic
-	if err := remotePeerKey.UnmarshalText([]byte(*remotePeer)); err != nil {
-		log.Fatalf("Invalid remote peer key: %v", err)
+	if *remotePeer == "" {
+		errs = append(errs, errors.New("--remote-peer is required"))
+	} else if k, err := keys.ParseNodePublic(*remotePeer); err != nil {
+		errs = append(errs, fmt.Errorf("--remote-peer: %w", err))
+	} else {
+		remotePeerKey = k
 	}
 
-	privKey, err := loadOrGenerateKey(*keyFile)
+	// --check is a dry run: it must not write a key file
+	loadKey := loadOrGenerateKey
+	if *check {
+		loadKey = readKey
+	}
+	privKey, err := loadKey(*keyFile)
 	if err != nil {
-		log.Fatalf("Failed to load/generate key: %v", err)
+		errs = append(errs, fmt.Errorf("failed to load/generate key: %w", err))
+	} else if privKey.Public() == remotePeerKey {
+		errs = append(errs, errors.New("--remote-peer is our own DERP public key"))
 	}
 
-	if *verbose {
-		log.Printf("Our public key: %s", privKey.Public())
-		log.Printf("Remote peer key: %s", remotePeerKey)
+	if u, err := url.Parse(*derpURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DERP URL: %w", err))
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		errs = append(errs, fmt.Errorf("invalid DERP URL %q: scheme must be https or http", *derpURL))
 	}
 
 	wgAddr, err := net.ResolveUDPAddr("udp", *wgEndpoint)
 	if err != nil {
-		log.Fatalf("Invalid WireGuard endpoint: %v", err)
+		errs = append(errs, fmt.Errorf("invalid WireGuard endpoint: %w", err))
 	}
 
 	listenUDPAddr, err := net.ResolveUDPAddr("udp", *listenAddr)
 	if err != nil {
-		log.Fatalf("Invalid listen address: %v", err)
+		errs = append(errs, fmt.Errorf("invalid listen address: %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if *check {
+		os.Exit(runCheck(privKey, remotePeerKey, wgAddr, listenUDPAddr))
+	}
+
+	if *verbose {
+		log.Printf("Our public key: %s", privKey.Public())
+		log.Printf("Remote peer key: %s", remotePeerKey)
 	}
 
 	udpConn, err := net.ListenUDP("udp", listenUDPAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on UDP: %v", err)
 	}
-	defer udpConn.Close()
 
 	log.Printf("UDP listener started on %s", *listenAddr)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	gw := &Gateway{
-		privateKey:    privKey,
-		udpConn:       udpConn,
-		remotePeerKey: remotePeerKey,
-		wgAddr:        wgAddr,
-		ctx:           ctx,
-	}
-
-	if err := gw.connectDERP(); err != nil {
+	derpClient, err := newDERPClient(privKey)
+	if err != nil {
 		log.Fatalf("Failed to connect to DERP: %v", err)
 	}
-	defer gw.derpClient.Close()
+	log.Printf("Connected to DERP server: %s", derpServer())
+
+	cfg := gateway.Config{
+		RemotePubKeyStr: remotePeerKey.String(),
+		DerpClient:      derpClient, // Closed by Stop
+		WGEndpoint:      *wgEndpoint,
+		DrainTimeout:    *drainTimeout,
+		Logger:          logging.Std("", *verbose),
+	}
+	if *verbose {
+		cfg.OnForward = logPacket
+	}
+	gw := gateway.New(cfg, udpConn)
+
+	if *statusListen != "" {
+		st := &statusServer{
+			gw:         gw,
+			nodeKey:    privKey.Public(),
+			remotePeer: remotePeerKey,
+			wgAddr:     wgAddr,
+			started:    time.Now(),
+		}
+		if err := st.serve(*statusListen); err != nil {
+			log.Fatalf("Failed to start status server: %v", err)
+		}
+	}
 
-	log.Printf("Connected to DERP server: %s", *derpURL)
+	if err := gw.Start(ctx); err != nil {
+		derpClient.Close()
+		log.Fatalf("Failed to start gateway: %v", err)
+	}
 	log.Printf("Gateway running. Press Ctrl+C to stop.")
 
-	errCh := make(chan error, 2)
-	go func() {
-		err := gw.udpToDERP()
-		log.Printf("udpToDERP goroutine exited: %v", err)
-		errCh <- err
-	}()
-	go func() {
-		err := gw.derpToUDP()
-		log.Printf("derpToUDP goroutine exited: %v", err)
-		errCh <- err
-	}()
-
-	select {
-	case err := <-errCh:
-		if err != nil {
-			log.Printf("Gateway error: %v", err)
-		}
-		log.Printf("Exiting due to goroutine error")
-	case <-ctx.Done():
-		log.Printf("Shutting down due to context cancellation: %v", ctx.Err())
-	}
+	<-ctx.Done()
+	log.Printf("Shutting down due to context cancellation: %v", ctx.Err())
+	gw.Stop() // Drains for up to --drain-timeout, then closes UDP and DERP
 }
 
-func (gw *Gateway) connectDERP() error {
+// newDERPClient creates the DERP client for --derp-url, or for the nearest
+// region of --derp-map. DERP's own logs are only shown with --verbose.
+func newDERPClient(privKey key.NodePrivate) (*derphttp.Client, error) {
 	logf := func(format string, args ...any) {
-		if *verbose {
-			log.Printf("[DERP] "+format, args...)
+		if !*verbose {
+			return
+		}
+		if *logFormat == "json" {
+			slog.Info(fmt.Sprintf(format, args...), "component", "derp")
+			return
+		}
+		log.Printf("[DERP] "+format, args...)
+	}
+
+	if *derpMap != "" {
+		dm, err := wgbind.LoadDERPMap(*derpMap)
+		if err != nil {
+			return nil, err
 		}
+		return wgbind.NewDERPClientFromMap(privKey, dm, logf, logging.Std("[derpbind]", *verbose))
 	}
 
 	// netmon (network monitor) tracks network state changes (interface up/down, IP changes, etc).
@@ -151,87 +205,68 @@ func (gw *Gateway) connectDERP() error {
 	// TODO: Consider using real netmon for production with automatic reconnection on network changes.
 	netMon := netmon.NewStatic()
 
-	client, err := derphttp.NewClient(gw.privateKey, *derpURL, logf, netMon)
+	client, err := derphttp.NewClient(privKey, *derpURL, logf, netMon)
 	if err != nil {
-		return fmt.Errorf("failed to create DERP client: %w", err)
+		return nil, fmt.Errorf("failed to create DERP client: %w", err)
 	}
-
-	gw.derpClient = client
-	return nil
+	return client, nil
 }
 
-func (gw *Gateway) udpToDERP() error {
-	buf := make([]byte, 65535)
-
-	for {
-		select {
-		case <-gw.ctx.Done():
-			return nil
-		default:
-		}
-
-		n, addr, err := gw.udpConn.ReadFromUDP(buf)
-		if err != nil {
-			if gw.ctx.Err() != nil {
-				return nil
-			}
-			log.Printf("UDP read error: %v", err)
-			continue
-		}
-
-		if *verbose {
-			log.Printf("UDP recv: %d bytes from %s", n, addr)
-		}
-
-		if err := gw.derpClient.Send(gw.remotePeerKey, buf[:n]); err != nil {
-			log.Printf("DERP send error: %v", err)
-			continue
-		}
-
-		if *verbose {
-			log.Printf("DERP sent: %d bytes to %s", n, gw.remotePeerKey.ShortString())
-		}
+// derpServer describes where the DERP client connects, for logs and status.
+func derpServer() string {
+	if *derpMap != "" {
+		return "nearest region of " + *derpMap
 	}
+	return *derpURL
 }
 
-func (gw *Gateway) derpToUDP() error {
-	for {
-		select {
-		case <-gw.ctx.Done():
-			return nil
-		default:
-		}
-
-		msg, err := gw.derpClient.Recv()
-		if err != nil {
-			if gw.ctx.Err() != nil {
-				return nil
-			}
-			log.Printf("DERP recv error: %v", err)
-			continue
-		}
-
-		switch m := msg.(type) {
-		case derp.ReceivedPacket:
-			if *verbose {
-				log.Printf("DERP recv: %d bytes from %s", len(m.Data), m.Source.ShortString())
-			}
-
-			n, err := gw.udpConn.WriteToUDP(m.Data, gw.wgAddr)
-			if err != nil {
-				log.Printf("UDP write error: %v", err)
-				continue
+// setupJSONLogging routes all logging (including the standard log package)
+// through a JSON handler writing to w, one object per line with the fields
+// ts, level, msg and, where relevant, component, src, dst, msg_type and bytes.
+func setupJSONLogging(w io.Writer) {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				a.Key = "ts"
 			}
+			return a
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+}
 
-			if *verbose {
-				log.Printf("UDP sent: %d bytes to %s", n, gw.wgAddr)
-			}
+// logPacket logs a forwarded packet. In JSON mode the details are emitted
+// as separate fields so log pipelines don't have to parse the message.
+func logPacket(event, src, dst string, data []byte) {
+	if *logFormat == "json" {
+		slog.Info(event,
+			"component", "gateway",
+			"src", src,
+			"dst", dst,
+			"msg_type", wgMessageType(data),
+			"bytes", len(data),
+		)
+		return
+	}
+	log.Printf("%s: %d bytes from %s to %s", event, len(data), src, dst)
+}
 
-		default:
-			if *verbose {
-				log.Printf("DERP: received non-packet message: %T", msg)
-			}
-		}
+// wgMessageType names the WireGuard message type of a packet (first byte).
+func wgMessageType(data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	switch data[0] {
+	case 1:
+		return "initiation"
+	case 2:
+		return "response"
+	case 3:
+		return "cookie_reply"
+	case 4:
+		return "transport"
+	default:
+		return "unknown"
 	}
 }
 
@@ -242,17 +277,12 @@ func loadOrGenerateKey(path string) (key.NodePrivate, error) {
 		return key.NewNode(), nil
 	}
 
-	// #nosec G304 - path is from CLI flag, user has filesystem access
-	data, err := os.ReadFile(path)
-	if err == nil {
-		var privKey key.NodePrivate
-		if err := privKey.UnmarshalText(bytes.TrimSpace(data)); err != nil {
-			return key.NodePrivate{}, fmt.Errorf("failed to parse key: %w", err)
-		}
-		return privKey, nil
+	privKey, err := readKey(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return privKey, err
 	}
 
-	privKey := key.NewNode()
+	privKey = key.NewNode()
 	marshaled, err := privKey.MarshalText()
 	if err != nil {
 		return key.NodePrivate{}, fmt.Errorf("failed to marshal key: %w", err)
@@ -265,3 +295,22 @@ func loadOrGenerateKey(path string) (key.NodePrivate, error) {
 	log.Printf("Generated new key and saved to %s", path)
 	return privKey, nil
 }
+
+// readKey is loadOrGenerateKey without the generating: a missing key file
+// is an error.
+func readKey(path string) (key.NodePrivate, error) {
+	if path == "" {
+		return key.NewNode(), nil // Ephemeral, see loadOrGenerateKey
+	}
+
+	// #nosec G304 - path is from CLI flag, user has filesystem access
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return key.NodePrivate{}, err
+	}
+	privKey, err := keys.ParseNodePrivate(string(data))
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("failed to parse key: %w", err)
+	}
+	return privKey, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONLogging(t *testing.T) {
+	// setupJSONLogging replaces the global loggers, put them back after
+	defaultLogger, logOutput, logFlags, format := slog.Default(), log.Writer(), log.Flags(), *logFormat
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		log.SetOutput(logOutput)
+		log.SetFlags(logFlags)
+		*logFormat = format
+	})
+
+	var buf bytes.Buffer
+	setupJSONLogging(&buf)
+	*logFormat = "json"
+
+	log.Printf("Gateway running")
+	logPacket("UDP sent", "[abc12]", "127.0.0.1:51820", []byte{4, 0, 0, 0, 1, 2, 3})
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line isn't JSON: %v\n%s", err, scanner.Bytes())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), buf.String())
+	}
+
+	// The standard log package goes through the same handler
+	for _, line := range lines {
+		if _, ok := line["ts"].(string); !ok {
+			t.Errorf("line has no ts: %v", line)
+		}
+		if line["level"] != "INFO" {
+			t.Errorf("level = %v, want INFO", line["level"])
+		}
+	}
+	if lines[0]["msg"] != "Gateway running" {
+		t.Errorf("msg = %v, want the log.Printf message", lines[0]["msg"])
+	}
+
+	want := map[string]any{
+		"msg":       "UDP sent",
+		"component": "gateway",
+		"src":       "[abc12]",
+		"dst":       "127.0.0.1:51820",
+		"msg_type":  "transport",
+		"bytes":     float64(7), // JSON numbers decode as float64
+	}
+	for field, v := range want {
+		if lines[1][field] != v {
+			t.Errorf("%s = %v, want %v", field, lines[1][field], v)
+		}
+	}
+}
+
+func TestReadKeyDoesNotGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "derp.key")
+
+	if _, err := readKey(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readKey of a missing file: err = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("readKey created the key file (stat: %v)", err)
+	}
+
+	// Once generated, both read the same key
+	generated, err := loadOrGenerateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := readKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Equal(generated) {
+		t.Error("readKey returned a different key than loadOrGenerateKey saved")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/drio/spanza/gateway"
+	"tailscale.com/types/key"
+)
+
+// statusResponse is the JSON served on /status, meant for dashboards that
+// collect the state of many gateways.
+type statusResponse struct {
+	Version       string       `json:"version"`
+	NodeKey       string       `json:"node_key"` // Our DERP public key
+	UptimeSeconds int64        `json:"uptime_seconds"`
+	DerpURL       string       `json:"derp_url"`
+	Listen        string       `json:"listen"`
+	WGEndpoint    string       `json:"wg_endpoint"`
+	Peers         []peerStatus `json:"peers"`
+}
+
+type peerStatus struct {
+	NodeKey       string     `json:"node_key"`
+	LastSeen      *time.Time `json:"last_seen"`      // Last packet from the peer, null if none yet
+	UptimeSeconds int64      `json:"uptime_seconds"` // Of the current session, 0 if down
+	PacketsIn     uint64     `json:"packets_in"`
+	PacketsOut    uint64     `json:"packets_out"`
+}
+
+// gatewayStatus is the part of *gateway.Gateway the status server uses.
+type gatewayStatus interface {
+	Status() gateway.Status
+}
+
+// statusServer serves the state of a running gateway (see handler).
+type statusServer struct {
+	gw         gatewayStatus
+	nodeKey    key.NodePublic // Our DERP public key
+	remotePeer key.NodePublic
+	wgAddr     net.Addr
+	started    time.Time
+}
+
+// readyResponse is the JSON served on /readyz.
+type readyResponse struct {
+	Ready         bool `json:"ready"`
+	DERPConnected bool `json:"derp_connected"`
+	PeersUp       int  `json:"peers_up"` // Peers heard from within gateway.SessionGap
+}
+
+// ready reports whether the gateway can forward packets: the UDP listener
+// is bound before the status server starts, so that leaves DERP.
+func (s *statusServer) ready() readyResponse {
+	st := s.gw.Status()
+	resp := readyResponse{DERPConnected: st.DERPConnected}
+	resp.Ready = resp.DERPConnected
+	if !st.SessionStart.IsZero() {
+		resp.PeersUp = 1
+	}
+	return resp
+}
+
+// status returns the gateway's current status.
+func (s *statusServer) status() statusResponse {
+	st := s.gw.Status()
+	peer := peerStatus{
+		NodeKey:    s.remotePeer.String(),
+		PacketsIn:  st.PacketsFromDERP,
+		PacketsOut: st.PacketsToDERP,
+	}
+	if !st.LastRecv.IsZero() {
+		t := st.LastRecv.UTC()
+		peer.LastSeen = &t
+	}
+	if !st.SessionStart.IsZero() {
+		peer.UptimeSeconds = int64(time.Since(st.SessionStart).Seconds())
+	}
+
+	return statusResponse{
+		Version:       version,
+		NodeKey:       s.nodeKey.String(),
+		UptimeSeconds: int64(time.Since(s.started).Seconds()),
+		DerpURL:       derpServer(),
+		Listen:        *listenAddr,
+		WGEndpoint:    s.wgAddr.String(),
+		Peers:         []peerStatus{peer},
+	}
+}
+
+// serve starts the HTTP status server on addr (see handler).
+// Listening errors are returned right away; the server then runs until the
+// process exits.
+func (s *statusServer) serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Status server listening on %s", ln.Addr())
+	go func() {
+		// #nosec G114 - local status endpoint, no timeouts needed
+		if err := http.Serve(ln, s.handler()); err != nil {
+			log.Printf("Status server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// handler serves /status, /healthz and /readyz.
+func (s *statusServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.status()); err != nil {
+			log.Printf("Failed to write status: %v", err)
+		}
+	})
+
+	// Liveness: the process is up and serving
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+
+	// Readiness: 503 until DERP is connected, so orchestrators hold off
+	// (or restart a gateway that never gets there)
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		resp := s.ready()
+		w.Header().Set("Content-Type", "application/json")
+		if !resp.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Failed to write readiness: %v", err)
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drio/spanza/gateway"
+	"tailscale.com/types/key"
+)
+
+// fakeGateway reports a fixed status.
+type fakeGateway struct {
+	st gateway.Status
+}
+
+func (g *fakeGateway) Status() gateway.Status { return g.st }
+
+// newTestStatusServer returns a status server for gw.
+func newTestStatusServer(gw gatewayStatus) *statusServer {
+	return &statusServer{
+		gw:         gw,
+		nodeKey:    key.NewNode().Public(),
+		remotePeer: key.NewNode().Public(),
+		wgAddr:     &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51820},
+		started:    time.Now(),
+	}
+}
+
+func TestStatusSchema(t *testing.T) {
+	gw := &fakeGateway{st: gateway.Status{PacketsToDERP: 3, PacketsFromDERP: 2}}
+	s := newTestStatusServer(gw)
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/status = %d, want 200", rec.Code)
+	}
+
+	// Decode loosely so the test checks the JSON field names, not just
+	// that statusResponse round-trips
+	var got struct {
+		Version string `json:"version"`
+		NodeKey string `json:"node_key"`
+		Peers   []struct {
+			NodeKey    string `json:"node_key"`
+			PacketsIn  uint64 `json:"packets_in"`
+			PacketsOut uint64 `json:"packets_out"`
+		} `json:"peers"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != version {
+		t.Errorf("version = %q, want %q", got.Version, version)
+	}
+	if got.NodeKey != s.nodeKey.String() {
+		t.Errorf("node_key = %q, want %q", got.NodeKey, s.nodeKey)
+	}
+	if len(got.Peers) != 1 {
+		t.Fatalf("got %d peers, want 1", len(got.Peers))
+	}
+	if p := got.Peers[0]; p.NodeKey != s.remotePeer.String() || p.PacketsIn != 2 || p.PacketsOut != 3 {
+		t.Errorf("peer = %+v, want %s with 2 packets in and 3 out", p, s.remotePeer)
+	}
+}
+
+func TestPeerUptime(t *testing.T) {
+	gw := &fakeGateway{}
+	s := newTestStatusServer(gw)
+	peer := s.status().Peers[0]
+	if peer.UptimeSeconds != 0 || peer.LastSeen != nil {
+		t.Fatalf("peer before any packet = %+v, want no uptime and never seen", peer)
+	}
+
+	// A session that started 10s ago and is still going
+	now := time.Now()
+	gw.st = gateway.Status{LastRecv: now, SessionStart: now.Add(-10 * time.Second)}
+	peer = s.status().Peers[0]
+	if peer.UptimeSeconds < 10 || peer.LastSeen == nil || !peer.LastSeen.Equal(now) {
+		t.Errorf("peer = %+v, want at least 10s up and last seen now", peer)
+	}
+
+	// The session is over: still last seen, but down
+	gw.st.SessionStart = time.Time{}
+	if peer := s.status().Peers[0]; peer.UptimeSeconds != 0 || peer.LastSeen == nil {
+		t.Errorf("peer after its session ended = %+v, want down but seen", peer)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	gw := &fakeGateway{}
+	handler := newTestStatusServer(gw).handler()
+
+	get := func(path string) (int, readyResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp readyResponse
+		if path == "/readyz" {
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	// Alive from the start, but not ready until DERP connects
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", code)
+	}
+	code, resp := get("/readyz")
+	if code != http.StatusServiceUnavailable || resp.Ready || resp.DERPConnected {
+		t.Errorf("/readyz before DERP connects = %d %+v, want 503 and not ready", code, resp)
+	}
+
+	gw.st = gateway.Status{DERPConnected: true, LastRecv: time.Now(), SessionStart: time.Now()}
+	code, resp = get("/readyz")
+	if code != http.StatusOK || !resp.Ready || resp.PeersUp != 1 {
+		t.Errorf("/readyz once connected = %d %+v, want 200, ready with 1 peer up", code, resp)
+	}
+
+	// Losing DERP makes it unready again
+	gw.st.DERPConnected = false
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after DERP is lost = %d, want 503", code)
+	}
+}
@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the live WireGuard state of a tunnel, as reported by IpcGet.
+type Status struct {
+	ListenPort int                   `json:"listen_port,omitempty"`
+	Peers      map[string]PeerStatus `json:"peers"` // Keyed by hex public key
+}
+
+// PeerStatus is the live state of one WireGuard peer.
+type PeerStatus struct {
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Nil until the first handshake completes
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// Status queries the WireGuard device for its current state.
+func (t *Tunnel) Status() (Status, error) {
+	text, err := t.dev.IpcGet()
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to query WireGuard: %w", err)
+	}
+	return ParseStatus(text)
+}
+
+// ParseStatus parses the key=value output of device.IpcGet. Keys it doesn't
+// report on (private_key, allowed_ip, ...) are skipped.
+func ParseStatus(text string) (Status, error) {
+	st := Status{Peers: make(map[string]PeerStatus)}
+
+	// Every key after a public_key line belongs to that peer, until the next one
+	var peerKey string
+	var peer PeerStatus
+	var handshakeSec, handshakeNsec int64
+	flush := func() {
+		if peerKey == "" {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			t := time.Unix(handshakeSec, handshakeNsec)
+			peer.LastHandshake = &t
+		}
+		st.Peers[peerKey] = peer
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return Status{}, fmt.Errorf("malformed IpcGet line %q", line)
+		}
+
+		var err error
+		switch k {
+		case "listen_port":
+			st.ListenPort, err = strconv.Atoi(v)
+		case "public_key":
+			flush()
+			peerKey, peer = v, PeerStatus{}
+			handshakeSec, handshakeNsec = 0, 0
+		case "endpoint":
+			peer.Endpoint = v
+		case "last_handshake_time_sec":
+			handshakeSec, err = strconv.ParseInt(v, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, err = strconv.ParseInt(v, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, err = strconv.ParseUint(v, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, err = strconv.ParseUint(v, 10, 64)
+		}
+		if err != nil {
+			return Status{}, fmt.Errorf("invalid %s: %w", k, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Status{}, err
+	}
+	flush()
+
+	return st, nil
+}
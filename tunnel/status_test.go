@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+// ipcGetOutput is what device.IpcGet returns for a device with two peers,
+// one of which never completed a handshake.
+const ipcGetOutput = `private_key=087ec6e14bbed210e7215cdc73468dfa23f080a1bfb8665b2fd809bd99d28379
+listen_port=51820
+public_key=c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+protocol_version=1
+endpoint=127.0.0.1:51821
+last_handshake_time_sec=1760000000
+last_handshake_time_nsec=500
+tx_bytes=1184
+rx_bytes=2096
+persistent_keepalive_interval=25
+allowed_ip=192.168.4.2/32
+public_key=f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+protocol_version=1
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=148
+rx_bytes=0
+persistent_keepalive_interval=0
+allowed_ip=0.0.0.0/0
+
+`
+
+func TestParseStatus(t *testing.T) {
+	st, err := ParseStatus(ipcGetOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ListenPort != 51820 {
+		t.Errorf("ListenPort = %d, want 51820", st.ListenPort)
+	}
+	if len(st.Peers) != 2 {
+		t.Fatalf("%d peers, want 2", len(st.Peers))
+	}
+
+	up := st.Peers["c4c8e984c5322c8184c72265b92b250fdb63688705f504ba003c88f03393cf28"]
+	if up.Endpoint != "127.0.0.1:51821" || up.RxBytes != 2096 || up.TxBytes != 1184 {
+		t.Errorf("peer = %+v", up)
+	}
+	if want := time.Unix(1760000000, 500); up.LastHandshake == nil || !up.LastHandshake.Equal(want) {
+		t.Errorf("LastHandshake = %v, want %v", up.LastHandshake, want)
+	}
+
+	down := st.Peers["f928d4f6c1b86c12f2562c10b07c555c5c57fd00f59e90c8d8d88767271cbf7c"]
+	if down.LastHandshake != nil || down.Endpoint != "" || down.TxBytes != 148 {
+		t.Errorf("peer without a handshake = %+v", down)
+	}
+}
+
+func TestParseStatusErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"no equals sign", "listen_port\n"},
+		{"bad port", "listen_port=port\n"},
+		{"bad counter", "public_key=ab\nrx_bytes=-1\n"},
+		{"bad handshake", "public_key=ab\nlast_handshake_time_sec=soon\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseStatus(tt.text); err == nil {
+				t.Errorf("ParseStatus(%q) succeeded", tt.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+// Package tunnel sets up a userspace WireGuard tunnel (netstack TUN +
+// wireguard-go device) with a single peer, so programs can dial and listen
+// through it without repeating the device boilerplate.
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/wgbind"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// minIPv6MTU is the smallest link MTU IPv6 allows.
+const minIPv6MTU = 1280
+
+// Config describes a tunnel and its peer.
+type Config struct {
+	LocalIP string // Our address inside the tunnel, e.g. "192.168.4.2"
+	DNS     string // Optional: DNS server inside the tunnel
+	MTU     int    // Optional: defaults to wgbind.RecommendedMTU for the Bind
+
+	// Our WireGuard private key, hex or base64
+	PrivateKey string
+
+	// Optional: UDP port to listen on (only meaningful for UDP binds)
+	ListenPort int
+
+	Peer PeerConfig
+
+	// Optional: how WireGuard packets travel, e.g. a wgbind.DerpBind or
+	// wgbind.NetstackBind. Defaults to kernel UDP (conn.NewDefaultBind).
+	Bind conn.Bind
+
+	// Optional: prefix for WireGuard's own log lines, and whether to log
+	// at all (device logging is silent unless Verbose is set)
+	LogPrefix string
+	Verbose   bool
+}
+
+// PeerConfig describes the WireGuard peer.
+type PeerConfig struct {
+	// The peer's WireGuard public key, hex or base64
+	PublicKey string
+
+	// Where to send packets: "IP:port" for UDP binds, the peer's DERP
+	// node key for a DerpBind. Optional if the peer initiates.
+	Endpoint string
+
+	// Optional: defaults to everything ("0.0.0.0/0" and "::/0")
+	AllowedIPs []string
+
+	// Optional: keepalive interval in seconds (0 disables)
+	PersistentKeepalive int
+}
+
+// Tunnel is a running userspace WireGuard tunnel.
+type Tunnel struct {
+	dev  *device.Device
+	tnet *netstack.Net
+}
+
+// New creates the network stack and WireGuard device described by cfg and
+// brings it up.
+func New(cfg Config) (*Tunnel, error) {
+	localIP, err := netip.ParseAddr(cfg.LocalIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local IP: %w", err)
+	}
+
+	var dns []netip.Addr
+	if cfg.DNS != "" {
+		addr, err := netip.ParseAddr(cfg.DNS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server: %w", err)
+		}
+		dns = append(dns, addr)
+	}
+
+	// Validate the MTU against the transport before creating anything: an
+	// oversized one doesn't fail, full-size packets just vanish
+	transport := transportOf(cfg.Bind)
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = wgbind.RecommendedMTU(transport)
+	}
+	if err := wgbind.CheckMTU(transport, mtu); err != nil {
+		return nil, err
+	}
+	if localIP.Is6() && mtu < minIPv6MTU {
+		return nil, fmt.Errorf("MTU %d is below the IPv6 minimum of %d", mtu, minIPv6MTU)
+	}
+
+	ipcConfig, err := cfg.ipcConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tunDev, tnet, err := netstack.CreateNetTUN([]netip.Addr{localIP}, dns, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN: %w", err)
+	}
+
+	bind := cfg.Bind
+	if bind == nil {
+		bind = conn.NewDefaultBind()
+	}
+
+	logLevel := device.LogLevelSilent
+	if cfg.Verbose {
+		logLevel = device.LogLevelVerbose
+	}
+	dev := device.NewDevice(tunDev, bind, device.NewLogger(logLevel, cfg.LogPrefix))
+
+	if err := dev.IpcSet(ipcConfig); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to configure WireGuard: %w", err)
+	}
+
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to bring up WireGuard: %w", err)
+	}
+
+	return &Tunnel{dev: dev, tnet: tnet}, nil
+}
+
+// transportOf returns the transport bind sends over, for MTU defaults and
+// limits. DERP over WebSocket can't be told apart; it has the same limit,
+// set MTU to use its slightly smaller recommended value.
+func transportOf(bind conn.Bind) wgbind.Transport {
+	if _, ok := bind.(*wgbind.DerpBind); ok {
+		return wgbind.TransportDERP
+	}
+	return wgbind.TransportUDP
+}
+
+// ipcConfig builds the IpcSet configuration for cfg.
+func (cfg Config) ipcConfig() (string, error) {
+	privHex, err := keys.WireGuardKeyHex(cfg.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("private key: %w", err)
+	}
+	peerHex, err := keys.WireGuardKeyHex(cfg.Peer.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("peer public key: %w", err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", privHex)
+	if cfg.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", cfg.ListenPort)
+	}
+	fmt.Fprintf(&b, "public_key=%s\n", peerHex)
+	if cfg.Peer.Endpoint != "" {
+		fmt.Fprintf(&b, "endpoint=%s\n", cfg.Peer.Endpoint)
+	}
+
+	allowedIPs := cfg.Peer.AllowedIPs
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	for _, prefix := range allowedIPs {
+		if _, err := netip.ParsePrefix(prefix); err != nil {
+			return "", fmt.Errorf("invalid allowed IP: %w", err)
+		}
+		fmt.Fprintf(&b, "allowed_ip=%s\n", prefix)
+	}
+
+	if cfg.Peer.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", cfg.Peer.PersistentKeepalive)
+	}
+	return b.String(), nil
+}
+
+// DialContext connects to addr through the tunnel, like net.Dialer.DialContext.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.tnet.DialContext(ctx, network, addr)
+}
+
+// ListenTCP listens on port on our tunnel address.
+func (t *Tunnel) ListenTCP(port int) (net.Listener, error) {
+	return t.tnet.ListenTCP(&net.TCPAddr{Port: port})
+}
+
+// HTTPClient returns an HTTP client whose connections go through the tunnel.
+func (t *Tunnel) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: t.tnet.DialContext,
+		},
+	}
+}
+
+// Net returns the userspace network stack, for anything the helpers above
+// don't cover (UDP, ping, ...).
+func (t *Tunnel) Net() *netstack.Net {
+	return t.tnet
+}
+
+// Device returns the WireGuard device, e.g. for IpcGet.
+func (t *Tunnel) Device() *device.Device {
+	return t.dev
+}
+
+// Close shuts down the WireGuard device, closing its TUN and bind.
+func (t *Tunnel) Close() error {
+	t.dev.Close()
+	return nil
+}
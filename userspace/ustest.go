@@ -7,13 +7,10 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/netip"
 	"time"
 
 	"github.com/drio/spanza/gateway"
-	"golang.zx2c4.com/wireguard/conn"
-	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun/netstack"
+	"github.com/drio/spanza/tunnel"
 )
 
 const (
@@ -133,39 +130,20 @@ func main() {
 func runPeer1(ctx context.Context, ready chan struct{}) {
 	log.Printf("[peer1] Starting WireGuard + Spanza gateway (%s)...", peer1IP)
 
-	// Create userspace WireGuard interface
-	// tun: TUN device for WireGuard to read/write packets
-	// tnet: Userspace TCP/IP stack (gvisor netstack) - implements standard Go net interfaces
-	//       (DialContext, ListenTCP, etc.) without kernel involvement
-	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(peer1IP)},
-		[]netip.Addr{netip.MustParseAddr(dnsIP)},
-		1420,
-	)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	// Create WireGuard device that wraps the TUN interface
-	// The device handles WireGuard protocol: encryption/decryption, handshakes, peer management
-	// It reads plaintext IP packets from tun, encrypts them, sends via UDP
-	// and receives encrypted UDP, decrypts them, writes back to tun
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
-
-	// Configure WireGuard to point to local Spanza gateway
-	wgConfig := fmt.Sprintf(`private_key=%s
-listen_port=%d
-public_key=%s
-allowed_ip=%s/32
-endpoint=127.0.0.1:%d
-persistent_keepalive_interval=25
-`, peer1WGPrivate, peer1WGPort, peer2WGPublic, peer2IP, peer1GatewayPort)
-
-	err = dev.IpcSet(wgConfig)
-	if err != nil {
-		log.Panic(err)
-	}
-	err = dev.Up()
+	// Userspace WireGuard interface: a gvisor netstack TUN wrapped by a
+	// WireGuard device using kernel UDP, pointed at the local Spanza gateway
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    peer1IP,
+		DNS:        dnsIP,
+		PrivateKey: peer1WGPrivate,
+		ListenPort: peer1WGPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey:           peer2WGPublic,
+			Endpoint:            fmt.Sprintf("127.0.0.1:%d", peer1GatewayPort),
+			AllowedIPs:          []string{peer2IP + "/32"},
+			PersistentKeepalive: 25,
+		},
+	})
 	if err != nil {
 		log.Panic(err)
 	}
@@ -175,7 +153,7 @@ persistent_keepalive_interval=25
 	// Start HTTP server on WireGuard network
 	log.Printf("[peer1] Starting HTTP server on %s:80...", peer1IP)
 
-	listener, err := tnet.ListenTCP(&net.TCPAddr{Port: 80})
+	listener, err := tun.ListenTCP(80)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -194,6 +172,7 @@ persistent_keepalive_interval=25
 		<-ctx.Done()
 		srv.Close()
 		listener.Close()
+		tun.Close()
 	}()
 
 	err = srv.Serve(listener)
@@ -205,41 +184,21 @@ persistent_keepalive_interval=25
 func runPeer2(ctx context.Context) {
 	log.Printf("[peer2] Starting WireGuard + Spanza gateway (%s)...", peer2IP)
 
-	// Create userspace WireGuard interface
-	// tun: TUN device for WireGuard to read/write packets
-	// tnet: Userspace TCP/IP stack (gvisor netstack) - implements standard Go net interfaces
-	//       (DialContext, ListenTCP, etc.) without kernel involvement
-	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.MustParseAddr(peer2IP)},
-		[]netip.Addr{netip.MustParseAddr(dnsIP)},
-		1420,
-	)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	// Create WireGuard device that wraps the TUN interface
-	// The device handles WireGuard protocol: encryption/decryption, handshakes, peer management
-	// It reads plaintext IP packets from tun, encrypts them, sends via UDP
-	// and receives encrypted UDP, decrypts them, writes back to tun
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
-
-	// Configure WireGuard to point to local Spanza gateway
-	wgConfig := fmt.Sprintf(`private_key=%s
-listen_port=%d
-public_key=%s
-allowed_ip=0.0.0.0/0
-endpoint=127.0.0.1:%d
-`, peer2WGPrivate, peer2WGPort, peer1WGPublic, peer2GatewayPort)
-
-	err = dev.IpcSet(wgConfig)
-	if err != nil {
-		log.Panic(err)
-	}
-	err = dev.Up()
+	// Userspace WireGuard interface, pointed at the local Spanza gateway
+	tun, err := tunnel.New(tunnel.Config{
+		LocalIP:    peer2IP,
+		DNS:        dnsIP,
+		PrivateKey: peer2WGPrivate,
+		ListenPort: peer2WGPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey: peer1WGPublic,
+			Endpoint:  fmt.Sprintf("127.0.0.1:%d", peer2GatewayPort),
+		},
+	})
 	if err != nil {
 		log.Panic(err)
 	}
+	defer tun.Close()
 
 	log.Println("[peer2] WireGuard interface up")
 
@@ -250,14 +209,10 @@ endpoint=127.0.0.1:%d
 	// Make HTTP request to peer1
 	log.Println("[peer2] Sending HTTP request to peer1...")
 
-	client := http.Client{
-		Transport: &http.Transport{
-			DialContext: tnet.DialContext,
-		},
-		Timeout: 10 * time.Second,
-	}
+	client := tun.HTTPClient()
+	client.Timeout = 10 * time.Second
 
-	resp, err := client.Get(fmt.Sprintf("http://%s/", peer1IP))
+	resp, err := client.Get(fmt.Sprintf("http://%s/", net.JoinHostPort(peer1IP, "80")))
 	if err != nil {
 		log.Fatalf("[peer2] HTTP request failed: %v", err)
 	}
@@ -0,0 +1,36 @@
+package wgbind
+
+import "time"
+
+// Clock is the source of time for DerpBind's time based logic (packet age,
+// idle disconnect, draining, send timeouts, RTT probes and the receive
+// loop's delays and backoff). Tests can substitute a fake one with WithClock
+// to drive it deterministically instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the default Clock, backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock replaces the real clock (see Clock).
+func WithClock(c Clock) DerpBindOption {
+	return func(b *DerpBind) {
+		b.clock = c
+	}
+}
+
+// sleep waits for d on the bind's clock. It returns false, early, if the
+// bind is closed meanwhile.
+func (b *DerpBind) sleep(d time.Duration) bool {
+	select {
+	case <-b.ctx.Done():
+		return false
+	case <-b.clock.After(d):
+		return true
+	}
+}
@@ -0,0 +1,117 @@
+package wgbind
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"tailscale.com/derp"
+)
+
+// fakeClock is a Clock that only moves when told to (see Advance).
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// waitForTimers waits (in real time) until n timers are pending, that is
+// until the code under test is blocked on the clock.
+func (c *fakeClock) waitForTimers(tb testing.TB, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d timers pending, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxPacketAgeWithFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn, WithClock(clock), WithMaxPacketAge(time.Second))
+
+	// Get the receive loop past its startup delay and first yield
+	clock.waitForTimers(t, 1)
+	clock.Advance(2 * time.Second)
+	clock.waitForTimers(t, 1)
+	clock.Advance(10 * time.Millisecond)
+
+	// A packet is queued, then sits there for longer than the max age
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("stale")}
+	clock.waitForTimers(t, 1)
+	if n := len(b.recvCh); n != 1 {
+		t.Fatalf("%d packets queued, want 1", n)
+	}
+	clock.Advance(2 * time.Second)
+
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("fresh")}
+
+	buffs := [][]byte{make([]byte, 64), make([]byte, 64)}
+	sizes := make([]int, len(buffs))
+	eps := make([]conn.Endpoint, len(buffs))
+	n, err := b.receiveDERP(buffs, sizes, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || string(buffs[0][:sizes[0]]) != "fresh" {
+		t.Errorf("received %d packets, first %q, want only %q", n, buffs[0][:sizes[0]], "fresh")
+	}
+	if got := b.StalePackets(); got != 1 {
+		t.Errorf("StalePackets = %d, want 1", got)
+	}
+}
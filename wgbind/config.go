@@ -0,0 +1,96 @@
+package wgbind
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/drio/spanza/keys"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/types/logger"
+)
+
+// DerpBindConfig describes a DerpBind along with the DERP client it uses.
+type DerpBindConfig struct {
+	DerpURL         string // e.g. "https://derp.tailscale.com/derp"
+	PrivKeyStr      string // Our DERP private key, "privkey:..." or bare hex
+	RemotePubKeyStr string // The peer's DERP public key, "nodekey:..." or bare hex
+
+	// Optional: DERP client logging. Defaults to the log package with a
+	// "[derp]" prefix.
+	Logf logger.Logf
+
+	// Optional: TLS settings for the DERP connection, e.g. a client
+	// certificate. See CheckDERPTLSConfig for what can't be set here.
+	TLSConfig *tls.Config
+
+	// Optional: adjusts each DERP client before use (timeouts, TLS, ...).
+	// Also applied to the clients created by Reconnect.
+	SetupClient func(*derphttp.Client)
+}
+
+// NewDerpBindFromConfig parses and validates cfg, then creates the DERP
+// client and a DerpBind over it. The client connects lazily, on first use;
+// call Connect to find out up front whether the server is reachable.
+//
+// The bind gets a dialer building clients from the same config, so Reconnect
+// works without WithDialer. opts are applied after it and can replace it.
+func NewDerpBindFromConfig(cfg DerpBindConfig, opts ...DerpBindOption) (*DerpBind, error) {
+	var errs []error
+	if u, err := url.Parse(cfg.DerpURL); err != nil {
+		errs = append(errs, fmt.Errorf("invalid DERP URL: %w", err))
+	} else if u.Scheme != "https" && u.Scheme != "http" {
+		errs = append(errs, fmt.Errorf("invalid DERP URL %q: scheme must be https or http", cfg.DerpURL))
+	} else if u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid DERP URL %q: missing host", cfg.DerpURL))
+	}
+
+	privKey, privErr := keys.ParseNodePrivate(cfg.PrivKeyStr)
+	if privErr != nil {
+		errs = append(errs, privErr)
+	}
+	remotePubKey, err := keys.ParseNodePublic(cfg.RemotePubKeyStr)
+	if err != nil {
+		errs = append(errs, err)
+	} else if privErr == nil && privKey.Public() == remotePubKey {
+		errs = append(errs, errors.New("remote public key is our own DERP public key"))
+	}
+
+	if err := CheckDERPTLSConfig(cfg.TLSConfig); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	logf := cfg.Logf
+	if logf == nil {
+		logf = func(format string, args ...any) {
+			log.Printf("[derp] "+format, args...)
+		}
+	}
+
+	dial := func() (DERPConn, error) {
+		client, err := derphttp.NewClient(privKey, cfg.DerpURL, logf, netmon.NewStatic())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DERP client: %w", err)
+		}
+		client.TLSConfig = cfg.TLSConfig
+		if cfg.SetupClient != nil {
+			cfg.SetupClient(client)
+		}
+		return client, nil
+	}
+
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]DerpBindOption{WithDialer(dial)}, opts...)
+	return NewDerpBind(client, remotePubKey, opts...), nil
+}
@@ -0,0 +1,73 @@
+package wgbind
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"tailscale.com/types/key"
+)
+
+func TestNewDerpBindFromConfigReportsEveryProblem(t *testing.T) {
+	_, err := NewDerpBindFromConfig(DerpBindConfig{
+		DerpURL:         "ftp://derp.example.com",
+		PrivKeyStr:      "privkey:nothex",
+		RemotePubKeyStr: "privkey:00",
+		TLSConfig:       &tls.Config{InsecureSkipVerify: true},
+	})
+	if err == nil {
+		t.Fatal("NewDerpBindFromConfig accepted a broken configuration")
+	}
+	for _, want := range []string{
+		"invalid DERP URL",
+		"invalid DERP private key",
+		"invalid DERP public key",
+		"InsecureSkipVerify",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestNewDerpBindFromConfig(t *testing.T) {
+	priv := key.NewNode()
+	privText, _ := priv.MarshalText()
+	cfg := DerpBindConfig{
+		DerpURL:         "https://derp.example.com/derp",
+		PrivKeyStr:      string(privText),
+		RemotePubKeyStr: testPeer.String(),
+	}
+
+	t.Run("missing host", func(t *testing.T) {
+		cfg := cfg
+		cfg.DerpURL = "https:///derp"
+		if _, err := NewDerpBindFromConfig(cfg); err == nil || !strings.Contains(err.Error(), "missing host") {
+			t.Errorf("err = %v, want an error about the host", err)
+		}
+	})
+
+	t.Run("own key", func(t *testing.T) {
+		cfg := cfg
+		cfg.RemotePubKeyStr = priv.Public().String()
+		if _, err := NewDerpBindFromConfig(cfg); err == nil || !strings.Contains(err.Error(), "our own") {
+			t.Errorf("err = %v, want an error about our own key", err)
+		}
+	})
+
+	// The client connects lazily, so a valid configuration doesn't touch
+	// the network
+	t.Run("valid", func(t *testing.T) {
+		b, err := NewDerpBindFromConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.client().Close()
+		if b.remotePubKey != testPeer {
+			t.Errorf("remote key = %s, want %s", b.remotePubKey.ShortString(), testPeer.ShortString())
+		}
+		if b.dial == nil {
+			t.Error("no dialer set, Reconnect wouldn't work")
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package wgbind
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/drio/spanza/logging"
+)
+
+// derpConnector is implemented by *derphttp.Client.
+type derpConnector interface {
+	Connect(ctx context.Context) error
+}
+
+// connectAttemptTimeout bounds a single connection attempt.
+const connectAttemptTimeout = 10 * time.Second
+
+// ConnectDERP connects client to its DERP server, trying up to attempts
+// times and doubling delay between tries.
+//
+// A DERP client otherwise connects lazily on first use and DerpBind keeps
+// retrying in the background, so an unreachable server at startup goes
+// unnoticed: the device comes up and simply never handshakes. Programs that
+// need the relay should call this first and give up with a clear error.
+// Failed attempts are logged to logger.
+func ConnectDERP(ctx context.Context, client derpConnector, attempts int, delay time.Duration, logger logging.Logger) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, connectAttemptTimeout)
+		err = client.Connect(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == attempts {
+			break
+		}
+		logger.Errorf("DERP connect attempt %d/%d failed: %v (retrying in %s)", attempt, attempts, err, delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	return fmt.Errorf("DERP server unreachable after %d attempts: %w", attempts, err)
+}
+
+// Connect connects the bind's current DERP client, see ConnectDERP. Clients
+// that don't connect explicitly (test doubles, wrappers) are left alone.
+func (b *DerpBind) Connect(ctx context.Context, attempts int, delay time.Duration) error {
+	client, ok := b.client().(derpConnector)
+	if !ok {
+		return nil
+	}
+	return ConnectDERP(ctx, client, attempts, delay, b.logger)
+}
+
+// Client returns the bind's current DERP client, or nil while disconnected
+// for idleness (see WithIdleDisconnect). Close only closes the client of an
+// opened bind, so a caller giving up on a bind before opening it (say,
+// because Connect failed) closes the client itself.
+func (b *DerpBind) Client() DERPConn {
+	return b.client()
+}
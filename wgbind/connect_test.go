@@ -0,0 +1,49 @@
+package wgbind
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingConnector is a DERP client whose server is unreachable.
+type failingConnector struct {
+	attempts int
+}
+
+var errUnreachable = errors.New("connection refused")
+
+func (c *failingConnector) Connect(ctx context.Context) error {
+	c.attempts++
+	return errUnreachable
+}
+
+func TestConnectDERPGivesUp(t *testing.T) {
+	client := &failingConnector{}
+	err := ConnectDERP(t.Context(), client, 3, time.Millisecond, nopLogger{})
+	if err == nil {
+		t.Fatal("ConnectDERP succeeded with an unreachable server")
+	}
+	if !errors.Is(err, errUnreachable) || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("err = %v, want the last connect error after 3 attempts", err)
+	}
+	if client.attempts != 3 {
+		t.Errorf("tried %d times, want 3", client.attempts)
+	}
+}
+
+func TestConnectDERPCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	// Cancelled while waiting to retry: no more attempts
+	client := &failingConnector{}
+	if err := ConnectDERP(ctx, client, 3, time.Hour, nopLogger{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if client.attempts != 1 {
+		t.Errorf("tried %d times, want 1", client.attempts)
+	}
+}
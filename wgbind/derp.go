@@ -2,12 +2,13 @@ package wgbind
 
 import (
 	"context"
-	"log"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/drio/spanza/logging"
 	"golang.zx2c4.com/wireguard/conn"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
@@ -20,12 +21,20 @@ import (
 // Unlike NetstackBind which uses userspace UDP + Gateway, DerpBind communicates
 // directly with a DERP server, similar to how Tailscale's MagicSock works in WASM.
 type DerpBind struct {
-	derpClient   *derphttp.Client
 	remotePubKey key.NodePublic
 
+	// The DERP client. It is swapped out by an idle disconnect (see
+	// WithIdleDisconnect) or Reconnect, use client()/connectedClient() to
+	// access it.
+	clientMu    sync.Mutex
+	derpClient  DERPConn
+	clientReady chan struct{} // Signals the receive loop that a new client is up
+
 	// Receive channel - packets from DERP are sent here
 	// This decouples the blocking derpClient.Recv() from WireGuard's receive loop
-	recvCh chan derpPacket
+	recvCh         chan derpPacket
+	recvQueueSize  int           // See WithRecvQueueSize
+	droppedPackets atomic.Uint64 // Packets dropped because recvCh was full
 
 	// Context for lifecycle management
 	ctx    context.Context
@@ -35,14 +44,115 @@ type DerpBind struct {
 	mu              sync.Mutex
 	closed          bool
 	recvLoopStarted bool // Track if receive loop has been started
+
+	// Packets that waited in recvCh longer than maxPacketAge are dropped
+	// instead of handed to WireGuard (0 disables). See WithMaxPacketAge.
+	maxPacketAge time.Duration
+	stalePackets atomic.Uint64
+
+	// Packets from a DERP source other than remotePubKey are dropped when
+	// filterSource is set. See WithSourceFilter.
+	filterSource   bool
+	foreignPackets atomic.Uint64
+
+	// Problems reported by the DERP server (overload, restarts, ...)
+	serverWarnings atomic.Uint64
+	health         atomic.Value // string, last HealthMessage problem ("" = healthy)
+
+	// Round-trip times to the DERP server (see WithRTTProbe)
+	rttInterval time.Duration
+	rttMu       sync.Mutex
+	rttHistory  []time.Duration
+
+	// Idle disconnect and reconnection (see WithIdleDisconnect, WithDialer)
+	idleTimeout time.Duration
+	dial        func() (DERPConn, error)
+	lastActive  atomic.Int64 // Unix nanos of the last send or received packet
+
+	// Sends blocked longer than sendTimeout fail (0 disables). See
+	// WithSendTimeout.
+	sendTimeout  time.Duration
+	stuckSends   atomic.Int32 // Timed out sends still blocked in the client
+	sendTimeouts atomic.Uint64
+
+	// Connection state (see WithStateCallbacks)
+	connected    atomic.Bool
+	stateCh      chan bool // Pending state changes for stateLoop, nil without callbacks
+	onConnect    func()
+	onDisconnect func()
+
+	clock  Clock          // See WithClock
+	logger logging.Logger // See WithLogger
+}
+
+// DerpBindOption configures optional DerpBind behavior.
+type DerpBindOption func(*DerpBind)
+
+// WithMaxPacketAge drops received packets that have been queued for longer
+// than d before WireGuard picks them up.
+//
+// DERP runs over TCP, so after congestion or a stalled reader a burst of old
+// packets can be sitting in the queue. WireGuard rejects stale transport
+// packets anyway, handing them over only wastes time while recovering.
+func WithMaxPacketAge(d time.Duration) DerpBindOption {
+	return func(b *DerpBind) {
+		b.maxPacketAge = d
+	}
+}
+
+// defaultRecvQueueSize is how many received packets can wait for WireGuard
+// before new ones are dropped.
+const defaultRecvQueueSize = 64
+
+// WithRecvQueueSize sets how many received packets can be queued for
+// WireGuard (default 64). Packets arriving while the queue is full are
+// dropped and counted (see DroppedPackets).
+func WithRecvQueueSize(n int) DerpBindOption {
+	return func(b *DerpBind) {
+		if n > 0 {
+			b.recvQueueSize = n
+		}
+	}
+}
+
+// WithSourceFilter drops received packets whose DERP source isn't the
+// configured remote peer, instead of handing them to WireGuard.
+//
+// Anyone who knows our DERP public key can send to us through the server.
+// WireGuard would reject such packets cryptographically, but only after
+// spending work on them, and they would show up as coming from our peer's
+// endpoint.
+func WithSourceFilter() DerpBindOption {
+	return func(b *DerpBind) {
+		b.filterSource = true
+	}
+}
+
+// WithLogger sets where DerpBind logs. The default logs to the standard
+// log package, without debug output.
+func WithLogger(l logging.Logger) DerpBindOption {
+	return func(b *DerpBind) {
+		b.logger = l
+	}
 }
 
 var _ conn.Bind = (*DerpBind)(nil)
 
+// DERPConn is the part of a DERP client that DerpBind uses.
+// *derphttp.Client satisfies it; wrappers like LossyConn can stand in for it.
+type DERPConn interface {
+	Send(dstKey key.NodePublic, b []byte) error
+	Recv() (derp.ReceivedMessage, error)
+	Close() error
+}
+
+var _ DERPConn = (*derphttp.Client)(nil)
+
 // derpPacket represents a received packet from DERP
 type derpPacket struct {
-	data []byte
-	from key.NodePublic
+	data     *[]byte // From recvBufPool, see getRecvBuf
+	from     key.NodePublic
+	received time.Time // When the packet came off the DERP connection
 }
 
 // DerpEndpoint implements conn.Endpoint for DERP.
@@ -67,21 +177,64 @@ func (e *DerpEndpoint) DstToBytes() []byte  { return e.publicKey.AppendTo(nil) }
 //   - remotePubKey: The DERP public key of the remote peer we'll communicate with
 //
 // The bind starts in a closed state. Call Open() to start receiving packets.
-func NewDerpBind(client *derphttp.Client, remotePubKey key.NodePublic) *DerpBind {
+func NewDerpBind(client DERPConn, remotePubKey key.NodePublic, opts ...DerpBindOption) *DerpBind {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	bind := &DerpBind{
-		derpClient:   client,
-		remotePubKey: remotePubKey,
-		recvCh:       make(chan derpPacket, 64), // Buffer for receive packets
-		ctx:          ctx,
-		cancel:       cancel,
-		closed:       true, // Start closed, Open() will set to false
+		derpClient:    client,
+		clientReady:   make(chan struct{}, 1),
+		remotePubKey:  remotePubKey,
+		recvQueueSize: defaultRecvQueueSize,
+		ctx:           ctx,
+		cancel:        cancel,
+		closed:        true, // Start closed, Open() will set to false
+		clock:         realClock{},
+		logger:        logging.Std("[derpbind]", false),
+	}
+
+	for _, opt := range opts {
+		opt(bind)
 	}
 
+	// Buffer for received packets
+	bind.recvCh = make(chan derpPacket, bind.recvQueueSize)
+
 	return bind
 }
 
+// ServerWarnings returns how many health, restart and similar warnings the
+// DERP server has sent. A growing count usually means DERP is throttling us.
+func (b *DerpBind) ServerWarnings() uint64 {
+	return b.serverWarnings.Load()
+}
+
+// Health returns the last problem reported by the DERP server, or "" if the
+// server says it is healthy (or never said anything).
+func (b *DerpBind) Health() string {
+	problem, _ := b.health.Load().(string)
+	return problem
+}
+
+// StalePackets returns the number of received packets dropped because they
+// exceeded the maximum packet age (see WithMaxPacketAge).
+func (b *DerpBind) StalePackets() uint64 {
+	return b.stalePackets.Load()
+}
+
+// DroppedPackets returns the number of received packets dropped because the
+// receive queue was full (see WithRecvQueueSize). WireGuard retransmits
+// handshakes, but dropped transport packets cost throughput, so a growing
+// count is worth alarming on.
+func (b *DerpBind) DroppedPackets() uint64 {
+	return b.droppedPackets.Load()
+}
+
+// ForeignPackets returns the number of received packets dropped because
+// they came from an unexpected DERP source (see WithSourceFilter).
+func (b *DerpBind) ForeignPackets() uint64 {
+	return b.foreignPackets.Load()
+}
+
 // Open implements conn.Bind.Open
 // This is called by WireGuard to set up the bind.
 //
@@ -96,15 +249,28 @@ func (b *DerpBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
 	}
 	b.closed = false
 
-	log.Println("[derpbind] Opening DERP bind...")
+	b.logger.Infof("Opening DERP bind...")
 
 	// Start receive loop immediately for WASM compatibility
 	// WASM has different goroutine scheduling, so we need the loop running
 	// before any sends happen to ensure proper message handling
 	if !b.recvLoopStarted {
 		b.recvLoopStarted = true
-		log.Println("[derpbind] Starting receive loop immediately (WASM compatibility)")
+		b.logger.Debugf("Starting receive loop immediately (WASM compatibility)")
 		go b.receiveLoop()
+
+		if b.rttInterval > 0 {
+			go b.rttLoop(b.rttInterval)
+		}
+
+		if b.stateCh != nil {
+			go b.stateLoop()
+		}
+
+		if b.idleTimeout > 0 && b.dial != nil {
+			b.lastActive.Store(b.clock.Now().UnixNano())
+			go b.idleLoop()
+		}
 	}
 
 	// Return a single receive function (DERP only, no UDP)
@@ -113,7 +279,7 @@ func (b *DerpBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
 
 	// Return fake port number (like MagicSock does for WASM)
 	// WireGuard requires a port number but we don't use UDP
-	log.Println("[derpbind] ✓ DERP bind opened with receive loop running")
+	b.logger.Infof("✓ DERP bind opened with receive loop running")
 	return fns, 12345, nil
 }
 
@@ -126,16 +292,36 @@ func (b *DerpBind) Close() error {
 		return nil
 	}
 
-	log.Println("[derpbind] Closing DERP bind...")
+	b.logger.Infof("Closing DERP bind...")
 	b.closed = true
 	b.cancel() // Stop receive loop
-	close(b.recvCh)
+
+	// recvCh is left open: the receive loop may still be sending to it, and
+	// receiveDERP returns as soon as it sees the canceled context.
 
 	return nil
 }
 
+// Drain waits up to timeout for WireGuard to pick up the packets already
+// queued from DERP, then closes the bind.
+//
+// Close drops whatever is still queued, which can lose the last response of
+// an exchange (e.g. in tests that shut down right after a reply arrives).
+func (b *DerpBind) Drain(timeout time.Duration) error {
+	deadline := b.clock.Now().Add(timeout)
+	for len(b.recvCh) > 0 && b.clock.Now().Before(deadline) {
+		<-b.clock.After(10 * time.Millisecond)
+	}
+
+	if n := len(b.recvCh); n > 0 {
+		b.logger.Errorf("Drain timed out after %s, dropping %d queued packets", timeout, n)
+	}
+	return b.Close()
+}
+
 // Send implements conn.Bind.Send
-// This is called by WireGuard when it wants to send packets.
+// This is called by WireGuard when it wants to send packets, up to
+// BatchSize at a time. The bind state and client are checked once per batch.
 func (b *DerpBind) Send(buffs [][]byte, ep conn.Endpoint) error {
 	b.mu.Lock()
 	if b.closed {
@@ -144,6 +330,16 @@ func (b *DerpBind) Send(buffs [][]byte, ep conn.Endpoint) error {
 	}
 	b.mu.Unlock()
 
+	// Reconnects first if the connection was closed for idleness
+	client, err := b.connectedClient()
+	if err != nil {
+		return err
+	}
+
+	if b.sendTimeout > 0 {
+		return b.sendWithTimeout(client, buffs)
+	}
+
 	// Send each packet via DERP
 	for _, buff := range buffs {
 		if len(buff) == 0 {
@@ -152,7 +348,7 @@ func (b *DerpBind) Send(buffs [][]byte, ep conn.Endpoint) error {
 
 		// Send to the remote peer via DERP
 		// This will establish the DERP WebSocket connection if not already connected
-		if err := b.derpClient.Send(b.remotePubKey, buff); err != nil {
+		if err := client.Send(b.remotePubKey, buff); err != nil {
 			// Error already logged by derpClient, just return it
 			return err
 		}
@@ -168,11 +364,19 @@ func (b *DerpBind) SetMark(mark uint32) error {
 }
 
 // BatchSize implements conn.Bind.BatchSize
-// Returns the batch size for sending/receiving packets
+// Returns the batch size for sending/receiving packets.
+//
+// DERP still carries one packet per frame, but taking batches lets Send
+// check state and pick the client once per batch, and lets receiveDERP
+// hand over everything already queued in one call.
 func (b *DerpBind) BatchSize() int {
-	return 1 // DERP sends one packet at a time
+	return derpBatchSize
 }
 
+// derpBatchSize is how many packets WireGuard passes to Send and
+// receiveDERP at once.
+const derpBatchSize = 16
+
 // ParseEndpoint implements conn.Bind.ParseEndpoint
 // WireGuard calls this to parse endpoint strings from configuration.
 // For DERP, we always return our single remote endpoint.
@@ -186,23 +390,53 @@ func (b *DerpBind) ParseEndpoint(s string) (conn.Endpoint, error) {
 // It reads packets from our receive channel.
 //
 // This is the function returned by Open() that WireGuard will call
-// repeatedly to receive packets.
+// repeatedly to receive packets. It blocks for the first packet, then fills
+// the rest of the batch with whatever is already queued.
 func (b *DerpBind) receiveDERP(buffs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
-	select {
-	case <-b.ctx.Done():
-		return 0, net.ErrClosed
-	case pkt, ok := <-b.recvCh:
-		if !ok {
+	count := 0
+	for count == 0 {
+		select {
+		case <-b.ctx.Done():
 			return 0, net.ErrClosed
+		case pkt, ok := <-b.recvCh:
+			if !ok {
+				return 0, net.ErrClosed
+			}
+			if b.deliver(pkt, buffs, sizes, eps, count) {
+				count++
+			}
 		}
+	}
 
-		// Copy packet data into WireGuard's buffer
-		n := copy(buffs[0], pkt.data)
-		sizes[0] = n
-		eps[0] = &DerpEndpoint{publicKey: pkt.from}
+	for count < len(buffs) {
+		select {
+		case pkt := <-b.recvCh:
+			if b.deliver(pkt, buffs, sizes, eps, count) {
+				count++
+			}
+		default:
+			return count, nil
+		}
+	}
+	return count, nil
+}
 
-		return 1, nil
+// deliver copies pkt into WireGuard's buffer i and returns the packet's
+// buffer to the pool. It reports false if the packet was dropped as stale.
+func (b *DerpBind) deliver(pkt derpPacket, buffs [][]byte, sizes []int, eps []conn.Endpoint, i int) bool {
+	defer putRecvBuf(pkt.data)
+
+	// Too old to be useful, WireGuard would reject it anyway
+	if b.maxPacketAge > 0 && b.clock.Now().Sub(pkt.received) > b.maxPacketAge {
+		if b.stalePackets.Add(1) == 1 {
+			b.logger.Infof("Dropping packets older than %s", b.maxPacketAge)
+		}
+		return false
 	}
+
+	sizes[i] = copy(buffs[i], *pkt.data)
+	eps[i] = &DerpEndpoint{publicKey: pkt.from}
+	return true
 }
 
 // receiveLoop runs in a goroutine and reads packets from DERP
@@ -213,12 +447,14 @@ func (b *DerpBind) receiveDERP(buffs [][]byte, sizes []int, eps []conn.Endpoint)
 // - We run it in a goroutine and feed results into a channel
 // - receiveDERP() reads from that channel non-blockingly
 func (b *DerpBind) receiveLoop() {
-	log.Println("[derpbind] Starting DERP receive loop...")
-	log.Println("[derpbind] Waiting for browser to initialize WebSocket...")
+	b.logger.Debugf("Starting DERP receive loop...")
+	b.logger.Debugf("Waiting for browser to initialize WebSocket...")
 
 	// In WASM, give the browser more time to fully initialize
 	// Progressive delays: start with longer wait, then retry with backoff
-	time.Sleep(2 * time.Second)
+	if !b.sleep(2 * time.Second) {
+		return
+	}
 
 	firstConnect := true
 	retryCount := 0
@@ -231,9 +467,22 @@ func (b *DerpBind) receiveLoop() {
 		}
 
 		// Yield to the JavaScript event loop
-		time.Sleep(10 * time.Millisecond)
+		if !b.sleep(10 * time.Millisecond) {
+			return
+		}
+
+		// Closed for idleness, wait until a Send reconnects
+		client := b.client()
+		if client == nil {
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-b.clientReady:
+			}
+			continue
+		}
 
-		msg, err := b.derpClient.Recv()
+		msg, err := client.Recv()
 		if err != nil {
 			select {
 			case <-b.ctx.Done():
@@ -241,11 +490,18 @@ func (b *DerpBind) receiveLoop() {
 			default:
 			}
 
+			b.setConnected(false)
+
+			// The client was closed on purpose (idle disconnect), not a failure
+			if b.client() != client {
+				continue
+			}
+
 			retryCount++
 			if retryCount == 1 {
-				log.Printf("[derpbind] Attempting connection (retry %d)...", retryCount)
+				b.logger.Debugf("Attempting connection (retry %d)...", retryCount)
 			} else if retryCount%2 == 0 {
-				log.Printf("[derpbind] Retrying (attempt %d)...", retryCount)
+				b.logger.Debugf("Retrying (attempt %d)...", retryCount)
 			}
 
 			// Exponential backoff after failed attempts
@@ -255,14 +511,17 @@ func (b *DerpBind) receiveLoop() {
 				if backoff > 3*time.Second {
 					backoff = 3 * time.Second
 				}
-				time.Sleep(backoff)
+				if !b.sleep(backoff) {
+					return
+				}
 			}
 			continue
 		}
 
 		// Connection succeeded
+		b.setConnected(true)
 		if firstConnect {
-			log.Printf("[derpbind] ✓ Connected to DERP after %d attempts", retryCount+1)
+			b.logger.Infof("✓ Connected to DERP after %d attempts", retryCount+1)
 			firstConnect = false
 		}
 		retryCount = 0
@@ -270,31 +529,66 @@ func (b *DerpBind) receiveLoop() {
 		// Handle different DERP message types
 		switch m := msg.(type) {
 		case derp.ReceivedPacket:
-			data := make([]byte, len(m.Data))
-			copy(data, m.Data)
+			if b.filterSource && m.Source != b.remotePubKey {
+				if b.foreignPackets.Add(1) == 1 {
+					b.logger.Errorf("WARNING: Dropping packets from unexpected source %s", m.Source.ShortString())
+				}
+				continue
+			}
+
+			b.lastActive.Store(b.clock.Now().UnixNano())
+
+			data := getRecvBuf(len(m.Data))
+			copy(*data, m.Data)
 
 			pkt := derpPacket{
-				data: data,
-				from: m.Source,
+				data:     data,
+				from:     m.Source,
+				received: b.clock.Now(),
 			}
 
 			select {
 			case b.recvCh <- pkt:
 				// Only log first few packets, then be quiet
 				if firstConnect {
-					log.Printf("[derpbind] Received %d bytes from %s", len(data), m.Source.ShortString())
+					b.logger.Debugf("Received %d bytes from %s", len(*data), m.Source.ShortString())
 				}
 			case <-b.ctx.Done():
 				return
 			default:
-				log.Println("[derpbind] WARNING: Receive queue full, dropping packet")
+				putRecvBuf(data)
+				if dropped := b.droppedPackets.Add(1); dropped == 1 || dropped%1000 == 0 {
+					b.logger.Errorf("WARNING: Receive queue full, dropping packet (%d dropped so far)", dropped)
+				}
 			}
 
 		case derp.ServerInfoMessage:
-			log.Println("[derpbind] ✓ Received ServerInfo from DERP")
+			b.logger.Infof("✓ Received ServerInfo from DERP")
+			if m.TokenBucketBytesPerSecond > 0 {
+				b.logger.Infof("DERP rate limit: %d bytes/s (burst %d)", m.TokenBucketBytesPerSecond, m.TokenBucketBytesBurst)
+			}
+
+		case derp.HealthMessage:
+			b.health.Store(m.Problem)
+			if m.Problem != "" {
+				b.serverWarnings.Add(1)
+				b.logger.Errorf("WARNING: DERP server unhealthy: %s", m.Problem)
+			} else {
+				b.logger.Infof("DERP server healthy again")
+			}
+
+		case derp.ServerRestartingMessage:
+			b.serverWarnings.Add(1)
+			b.logger.Errorf("WARNING: DERP server restarting (reconnect in %s, retry for %s)", m.ReconnectIn, m.TryFor)
+
+		case derp.PeerGoneMessage:
+			b.logger.Infof("Peer %s gone from DERP server (reason %v)", m.Peer.ShortString(), m.Reason)
+
+		case derp.KeepAliveMessage, derp.PingMessage, derp.PongMessage:
+			// Routine connection maintenance
 
 		default:
-			// Silently ignore other message types (like KeepAlive)
+			b.logger.Debugf("Ignoring DERP message type %T", msg)
 		}
 	}
 }
@@ -0,0 +1,353 @@
+package wgbind
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// nopLogger keeps the bind quiet in tests.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
+
+// fakeConn is a DERPConn for tests: messages pushed into recv are received
+// by the bind, its sends land in sent. Ping answers after pingDelay, like a
+// DERP server that far away.
+type fakeConn struct {
+	recv      chan derp.ReceivedMessage
+	sent      chan []byte
+	pingDelay time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		recv:   make(chan derp.ReceivedMessage, 16),
+		sent:   make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) Send(dstKey key.NodePublic, b []byte) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	case c.sent <- append([]byte(nil), b...):
+		return nil
+	}
+}
+
+func (c *fakeConn) Recv() (derp.ReceivedMessage, error) {
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case msg := <-c.recv:
+		return msg, nil
+	}
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.pingDelay):
+		return nil
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// isClosed reports whether Close has been called.
+func (c *fakeConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+var testPeer = key.NewNode().Public()
+
+// newTestBind returns an open DerpBind over conn, closed with the test.
+func newTestBind(tb testing.TB, conn DERPConn, opts ...DerpBindOption) *DerpBind {
+	tb.Helper()
+	opts = append([]DerpBindOption{WithLogger(nopLogger{})}, opts...)
+	b := NewDerpBind(conn, testPeer, opts...)
+	if _, _, err := b.Open(0); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { b.Close() })
+	return b
+}
+
+// receiveOne waits for the next packet WireGuard would get from b.
+func receiveOne(tb testing.TB, b *DerpBind) ([]byte, conn.Endpoint) {
+	tb.Helper()
+	buffs := [][]byte{make([]byte, 2048)}
+	sizes := make([]int, 1)
+	eps := make([]conn.Endpoint, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.receiveDERP(buffs, sizes, eps)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			tb.Fatalf("receiveDERP: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		tb.Fatal("no packet received")
+	}
+	return buffs[0][:sizes[0]], eps[0]
+}
+
+func TestSourceFilterDropsForeignPackets(t *testing.T) {
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn, WithSourceFilter())
+
+	stranger := key.NewNode().Public()
+	derpConn.recv <- derp.ReceivedPacket{Source: stranger, Data: []byte("injected")}
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("from peer")}
+
+	data, ep := receiveOne(t, b)
+	if string(data) != "from peer" {
+		t.Errorf("received %q, want %q", data, "from peer")
+	}
+	if got := ep.(*DerpEndpoint).publicKey; got != testPeer {
+		t.Errorf("endpoint key = %s, want %s", got.ShortString(), testPeer.ShortString())
+	}
+	if got := b.ForeignPackets(); got != 1 {
+		t.Errorf("ForeignPackets = %d, want 1", got)
+	}
+}
+
+func TestNoSourceFilterAcceptsAnySource(t *testing.T) {
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn)
+
+	stranger := key.NewNode().Public()
+	derpConn.recv <- derp.ReceivedPacket{Source: stranger, Data: []byte("anyone")}
+
+	if data, _ := receiveOne(t, b); string(data) != "anyone" {
+		t.Errorf("received %q, want %q", data, "anyone")
+	}
+	if got := b.ForeignPackets(); got != 0 {
+		t.Errorf("ForeignPackets = %d, want 0", got)
+	}
+}
+
+// discardConn is a DERPConn that accepts every send and never receives.
+type discardConn struct {
+	closed chan struct{}
+}
+
+func (c discardConn) Send(key.NodePublic, []byte) error { return nil }
+
+func (c discardConn) Recv() (derp.ReceivedMessage, error) {
+	<-c.closed
+	return nil, net.ErrClosed
+}
+
+func (c discardConn) Close() error { return nil }
+
+// BenchmarkSend compares handing WireGuard's packets to Send one at a time
+// with full batches (BatchSize), reported as packets sent per second.
+func BenchmarkSend(b *testing.B) {
+	packet := make([]byte, 1420+wireGuardOverhead)
+
+	for _, batch := range []int{1, derpBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			derpConn := discardConn{closed: make(chan struct{})}
+			defer close(derpConn.closed)
+			bind := newTestBind(b, derpConn)
+			ep, _ := bind.ParseEndpoint("")
+
+			buffs := make([][]byte, batch)
+			for i := range buffs {
+				buffs[i] = packet
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for sent := 0; sent < b.N; sent += batch {
+				if err := bind.Send(buffs, ep); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "sends/s")
+		})
+	}
+}
+
+func TestRecvQueueSize(t *testing.T) {
+	if b := NewDerpBind(newFakeConn(), testPeer); cap(b.recvCh) != defaultRecvQueueSize {
+		t.Errorf("default queue size = %d, want %d", cap(b.recvCh), defaultRecvQueueSize)
+	}
+
+	clock := newFakeClock()
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn, WithClock(clock), WithRecvQueueSize(2))
+
+	// Nobody reads from the bind, so only the first two packets fit
+	const sent = 5
+	for i := 0; i < sent; i++ {
+		derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte{byte(i)}}
+	}
+	clock.waitForTimers(t, 1)
+	clock.Advance(2 * time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.DroppedPackets() < sent-2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("DroppedPackets = %d, want %d", b.DroppedPackets(), sent-2)
+		}
+		clock.waitForTimers(t, 1)
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	if n := len(b.recvCh); n != 2 {
+		t.Errorf("%d packets queued, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if data, _ := receiveOne(t, b); len(data) != 1 || data[0] != byte(i) {
+			t.Errorf("packet %d = %v, want [%d]", i, data, i)
+		}
+	}
+	if got := b.DroppedPackets(); got != sent-2 {
+		t.Errorf("DroppedPackets = %d, want %d", got, sent-2)
+	}
+}
+
+func TestServerWarnings(t *testing.T) {
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn)
+
+	// Messages are handled in order, so once the packet behind them is
+	// received the bind has seen the warnings
+	derpConn.recv <- derp.HealthMessage{Problem: "overloaded"}
+	derpConn.recv <- derp.ServerRestartingMessage{ReconnectIn: time.Second, TryFor: time.Minute}
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("after warnings")}
+	receiveOne(t, b)
+
+	if got := b.ServerWarnings(); got != 2 {
+		t.Errorf("ServerWarnings = %d, want 2", got)
+	}
+	if got := b.Health(); got != "overloaded" {
+		t.Errorf("Health = %q, want %q", got, "overloaded")
+	}
+
+	// Healthy again: the problem clears, the warning count stays
+	derpConn.recv <- derp.HealthMessage{}
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("after recovery")}
+	receiveOne(t, b)
+
+	if got := b.Health(); got != "" {
+		t.Errorf("Health = %q after recovering, want healthy", got)
+	}
+	if got := b.ServerWarnings(); got != 2 {
+		t.Errorf("ServerWarnings = %d after recovering, want still 2", got)
+	}
+}
+
+// waitQueued waits until n received packets are queued for WireGuard.
+func waitQueued(tb testing.TB, b *DerpBind, n int) {
+	tb.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(b.recvCh) < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("%d packets queued, want %d", len(b.recvCh), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// bindClosed reports whether b has been closed.
+func bindClosed(b *DerpBind) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func TestDrainDeliversQueuedPackets(t *testing.T) {
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn)
+
+	want := []string{"one", "two", "three"}
+	for _, data := range want {
+		derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte(data)}
+	}
+	waitQueued(t, b, len(want))
+
+	drained := make(chan error, 1)
+	go func() { drained <- b.Drain(5 * time.Second) }()
+
+	// Nothing has been picked up yet, so Drain keeps the bind open
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned (%v) with %d packets queued", err, len(b.recvCh))
+	case <-time.After(100 * time.Millisecond):
+	}
+	if bindClosed(b) {
+		t.Fatal("bind closed while packets were queued")
+	}
+
+	for _, w := range want {
+		if data, _ := receiveOne(t, b); string(data) != w {
+			t.Errorf("received %q, want %q", data, w)
+		}
+	}
+
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Drain: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain didn't return once the queue was empty")
+	}
+	if !bindClosed(b) {
+		t.Error("bind still open after Drain")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn)
+
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("never read")}
+	waitQueued(t, b, 1)
+
+	// Nobody reads, so Drain gives up after the timeout and closes anyway
+	start := time.Now()
+	if err := b.Drain(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Drain took %s, want about the 100ms timeout", elapsed)
+	}
+	if !bindClosed(b) {
+		t.Error("bind still open after Drain timed out")
+	}
+	if n := len(b.recvCh); n != 1 {
+		t.Errorf("%d packets queued after Drain, want the unread one left behind", n)
+	}
+}
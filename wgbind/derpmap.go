@@ -0,0 +1,149 @@
+package wgbind
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/drio/spanza/logging"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// regionProbeTimeout bounds how long a latency probe waits for a DERP node.
+const regionProbeTimeout = 2 * time.Second
+
+// LoadDERPMap reads a Tailscale-style DERP map (the JSON served at
+// https://login.tailscale.com/derpmap/default) from path.
+func LoadDERPMap(path string) (*tailcfg.DERPMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var dm tailcfg.DERPMap
+	if err := json.Unmarshal(data, &dm); err != nil {
+		return nil, fmt.Errorf("invalid DERP map %s: %w", path, err)
+	}
+	if len(dm.Regions) == 0 {
+		return nil, fmt.Errorf("DERP map %s has no regions", path)
+	}
+	return &dm, nil
+}
+
+// NewDERPClientFromMap creates a DERP client that uses the nearest region of
+// derpMap instead of a fixed server URL.
+//
+// Regions are ranked by TCP connect time to their nodes. The client asks for
+// its region every time it (re)connects, so the ranking is redone then: if
+// the home region goes down, the next reconnect fails over to the fastest
+// region still answering. Regions marked Avoid or NoMeasureNoHome are never
+// picked. It returns an error if no region is reachable now.
+//
+// Self-hosted nodes with a private certificate can be pinned with the node's
+// CertName ("sha256-raw:<hex>"). TLSConfig can be set on the returned client
+// before first use (see CheckDERPTLSConfig).
+//
+// logf receives the DERP client's own logs, logger the region choices.
+func NewDERPClientFromMap(privKey key.NodePrivate, derpMap *tailcfg.DERPMap, logf logger.Logf, log logging.Logger) (*derphttp.Client, error) {
+	home, latency := nearestRegion(context.Background(), derpMap)
+	if home == nil {
+		return nil, errors.New("no DERP region reachable")
+	}
+	log.Infof("Using DERP region %d (%s, %s), %s away", home.RegionID, home.RegionCode, home.RegionName, latency.Round(time.Millisecond))
+
+	var mu sync.Mutex
+	getRegion := func() *tailcfg.DERPRegion {
+		mu.Lock()
+		defer mu.Unlock()
+
+		region, latency := nearestRegion(context.Background(), derpMap)
+		if region == nil {
+			// Nothing answered the probe; let the client try the last home
+			return home
+		}
+		if region.RegionID != home.RegionID {
+			log.Infof("Switching DERP region %d (%s) -> %d (%s), %s away",
+				home.RegionID, home.RegionCode, region.RegionID, region.RegionCode, latency.Round(time.Millisecond))
+			home = region
+		}
+		return home
+	}
+
+	return derphttp.NewRegionClient(privKey, logf, netmon.NewStatic(), getRegion), nil
+}
+
+// nearestRegion probes every eligible region concurrently and returns the
+// one with the lowest latency, or nil if none answered.
+func nearestRegion(ctx context.Context, derpMap *tailcfg.DERPMap) (*tailcfg.DERPRegion, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, regionProbeTimeout)
+	defer cancel()
+
+	type result struct {
+		region  *tailcfg.DERPRegion
+		latency time.Duration
+	}
+	results := make(chan result, len(derpMap.Regions))
+
+	var wg sync.WaitGroup
+	for _, region := range derpMap.Regions {
+		if region == nil || region.Avoid || region.NoMeasureNoHome {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if latency, ok := probeRegion(ctx, region); ok {
+				results <- result{region, latency}
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var best result
+	for r := range results {
+		if best.region == nil || r.latency < best.latency {
+			best = r
+		}
+	}
+	return best.region, best.latency
+}
+
+// probeRegion returns the fastest TCP connect time to any of the region's
+// DERP nodes.
+func probeRegion(ctx context.Context, region *tailcfg.DERPRegion) (time.Duration, bool) {
+	var best time.Duration
+	found := false
+	for _, node := range region.Nodes {
+		if node.STUNOnly {
+			continue
+		}
+		port := node.DERPPort
+		if port == 0 {
+			port = 443
+		}
+
+		var d net.Dialer
+		start := time.Now()
+		c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(node.HostName, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		latency := time.Since(start)
+		c.Close()
+
+		if !found || latency < best {
+			best, found = latency, true
+		}
+	}
+	return best, found
+}
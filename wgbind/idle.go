@@ -0,0 +1,81 @@
+package wgbind
+
+import (
+	"fmt"
+	"time"
+)
+
+// WithIdleDisconnect closes the DERP connection after timeout without any
+// traffic and dials a new one (with dial) on the next Send.
+//
+// This is meant for the browser, where an idle WebSocket wastes battery and
+// network. Every outgoing packet, handshakes included, reconnects right away.
+// While disconnected the remote peer can't reach us, so only use this when
+// we are the one initiating (and without persistent_keepalive, which would
+// keep the connection busy anyway).
+func WithIdleDisconnect(timeout time.Duration, dial func() (DERPConn, error)) DerpBindOption {
+	return func(b *DerpBind) {
+		b.idleTimeout = timeout
+		b.dial = dial
+	}
+}
+
+// client returns the current DERP client, or nil while disconnected for idleness.
+func (b *DerpBind) client() DERPConn {
+	b.clientMu.Lock()
+	defer b.clientMu.Unlock()
+	return b.derpClient
+}
+
+// connectedClient returns the current DERP client, dialing a new one if the
+// previous one was closed for idleness.
+func (b *DerpBind) connectedClient() (DERPConn, error) {
+	b.clientMu.Lock()
+	defer b.clientMu.Unlock()
+
+	b.lastActive.Store(b.clock.Now().UnixNano())
+
+	if b.derpClient != nil {
+		return b.derpClient, nil
+	}
+
+	b.logger.Infof("Reconnecting to DERP after idle disconnect...")
+	client, err := b.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconnect to DERP: %w", err)
+	}
+	b.derpClient = client
+
+	// Wake up the receive loop, it parks while there is no client
+	select {
+	case b.clientReady <- struct{}{}:
+	default:
+	}
+
+	return client, nil
+}
+
+// idleLoop closes the DERP client once there has been no traffic for
+// idleTimeout, until the bind is closed.
+func (b *DerpBind) idleLoop() {
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-b.clock.After(b.idleTimeout / 4):
+		}
+
+		idle := b.clock.Now().Sub(time.Unix(0, b.lastActive.Load()))
+		if idle < b.idleTimeout {
+			continue
+		}
+
+		b.clientMu.Lock()
+		if b.derpClient != nil {
+			b.logger.Infof("No traffic for %s, closing DERP connection", idle.Round(time.Second))
+			b.derpClient.Close()
+			b.derpClient = nil
+		}
+		b.clientMu.Unlock()
+	}
+}
@@ -0,0 +1,55 @@
+package wgbind
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleDisconnectAndReconnectOnSend(t *testing.T) {
+	first := newFakeConn()
+
+	var mu sync.Mutex
+	var dialed []*fakeConn
+	dial := func() (DERPConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		c := newFakeConn()
+		dialed = append(dialed, c)
+		return c, nil
+	}
+
+	b := newTestBind(t, first, WithIdleDisconnect(100*time.Millisecond, dial))
+
+	// Nothing is sent or received: the connection is closed after the window
+	deadline := time.Now().Add(2 * time.Second)
+	for !first.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.client() != nil {
+		t.Fatal("bind still has a client after the idle disconnect")
+	}
+
+	// The next packet dials a new connection and goes out on it
+	ep, _ := b.ParseEndpoint("")
+	if err := b.Send([][]byte{[]byte("handshake")}, ep); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 {
+		t.Fatalf("dialed %d times, want 1", len(dialed))
+	}
+	select {
+	case pkt := <-dialed[0].sent:
+		if string(pkt) != "handshake" {
+			t.Errorf("sent %q, want %q", pkt, "handshake")
+		}
+	default:
+		t.Error("packet not sent on the new connection")
+	}
+}
@@ -0,0 +1,123 @@
+package wgbind
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// LossyConn wraps a DERPConn and makes it behave like an unreliable relay.
+// It drops, delays and duplicates packets in both directions so DerpBind,
+// the gateway and WireGuard's handshake retries can be exercised without a
+// bad network.
+//
+// Only data packets are affected; control messages (ServerInfo, KeepAlive,
+// ...) pass through untouched.
+type LossyConn struct {
+	conn DERPConn
+
+	loss      float64       // Probability [0, 1] that a packet is dropped
+	latency   time.Duration // Delay added to every packet
+	duplicate float64       // Probability [0, 1] that a packet is delivered twice
+
+	// A duplicated received packet waiting to be returned by the next Recv
+	mu      sync.Mutex
+	pending *derp.ReceivedPacket
+}
+
+var _ DERPConn = (*LossyConn)(nil)
+
+// NewLossyConn wraps conn with the given loss and duplication probabilities
+// (0 to 1) and a fixed one-way latency.
+func NewLossyConn(conn DERPConn, loss float64, latency time.Duration, duplicate float64) *LossyConn {
+	return &LossyConn{
+		conn:      conn,
+		loss:      loss,
+		latency:   latency,
+		duplicate: duplicate,
+	}
+}
+
+// Send forwards b to the wrapped conn, unless it is "lost".
+// Delayed packets are sent from a timer, so their errors are not reported.
+func (c *LossyConn) Send(dstKey key.NodePublic, b []byte) error {
+	if rand.Float64() < c.loss {
+		return nil // Lost on the way, as far as the caller can tell it was sent
+	}
+
+	copies := 1
+	if rand.Float64() < c.duplicate {
+		copies = 2
+	}
+
+	if c.latency <= 0 {
+		for i := 0; i < copies; i++ {
+			if err := c.conn.Send(dstKey, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The caller may reuse b once we return, keep our own copy
+	data := append([]byte(nil), b...)
+	time.AfterFunc(c.latency, func() {
+		for i := 0; i < copies; i++ {
+			c.conn.Send(dstKey, data)
+		}
+	})
+	return nil
+}
+
+// Recv returns the next message from the wrapped conn, dropping, delaying
+// and duplicating received packets.
+func (c *LossyConn) Recv() (derp.ReceivedMessage, error) {
+	c.mu.Lock()
+	if c.pending != nil {
+		pkt := *c.pending
+		c.pending = nil
+		c.mu.Unlock()
+		return pkt, nil
+	}
+	c.mu.Unlock()
+
+	for {
+		msg, err := c.conn.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		pkt, ok := msg.(derp.ReceivedPacket)
+		if !ok {
+			return msg, nil
+		}
+
+		if rand.Float64() < c.loss {
+			continue
+		}
+
+		if c.latency > 0 {
+			time.Sleep(c.latency)
+		}
+
+		if rand.Float64() < c.duplicate {
+			dup := derp.ReceivedPacket{
+				Source: pkt.Source,
+				Data:   append([]byte(nil), pkt.Data...),
+			}
+			c.mu.Lock()
+			c.pending = &dup
+			c.mu.Unlock()
+		}
+
+		return pkt, nil
+	}
+}
+
+// Close closes the wrapped conn.
+func (c *LossyConn) Close() error {
+	return c.conn.Close()
+}
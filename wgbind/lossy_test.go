@@ -0,0 +1,134 @@
+package wgbind_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/drio/spanza/keys"
+	"github.com/drio/spanza/tunnel"
+	"github.com/drio/spanza/wgbind"
+	"tailscale.com/types/key"
+)
+
+// nopLogger keeps the binds quiet in tests.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...any) {}
+func (nopLogger) Infof(string, ...any)  {}
+func (nopLogger) Errorf(string, ...any) {}
+
+// newDERPTunnels connects two tunnels (10.0.0.1 and 10.0.0.2) through
+// DerpBinds over an in-memory DERP pair, passing each end through wrap.
+func newDERPTunnels(t *testing.T, wrap func(wgbind.DERPConn) wgbind.DERPConn) (server, client *tunnel.Tunnel) {
+	t.Helper()
+
+	derpServer, derpClient := key.NewNode(), key.NewNode()
+	serverConn, clientConn := wgbind.NewMemDERPPair(derpServer.Public(), derpClient.Public())
+
+	serverBind := wgbind.NewDerpBind(wrap(serverConn), derpClient.Public(), wgbind.WithLogger(nopLogger{}))
+	clientBind := wgbind.NewDerpBind(wrap(clientConn), derpServer.Public(), wgbind.WithLogger(nopLogger{}))
+
+	serverPriv, serverPub := newWireGuardKeys(t)
+	clientPriv, clientPub := newWireGuardKeys(t)
+
+	server, err := tunnel.New(tunnel.Config{
+		LocalIP:    "10.0.0.1",
+		PrivateKey: serverPriv,
+		Peer: tunnel.PeerConfig{
+			PublicKey:  clientPub,
+			AllowedIPs: []string{"10.0.0.2/32"},
+		},
+		Bind: serverBind,
+	})
+	if err != nil {
+		t.Fatalf("server tunnel: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err = tunnel.New(tunnel.Config{
+		LocalIP:    "10.0.0.2",
+		PrivateKey: clientPriv,
+		Peer: tunnel.PeerConfig{
+			PublicKey: serverPub,
+			Endpoint:  derpServer.Public().String(),
+		},
+		Bind: clientBind,
+	})
+	if err != nil {
+		t.Fatalf("client tunnel: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return server, client
+}
+
+// newWireGuardKeys returns a fresh WireGuard private key and its public key.
+func newWireGuardKeys(t testing.TB) (priv, pub string) {
+	t.Helper()
+	priv, err := keys.NewWireGuardPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err = keys.WireGuardPublicKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+// serveHello serves "hello" over HTTP on port 80 of tun.
+func serveHello(t *testing.T, tun *tunnel.Tunnel) {
+	t.Helper()
+	ln, err := tun.ListenTCP(80)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestLossyConnHTTPRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for WireGuard handshake retries")
+	}
+
+	server, client := newDERPTunnels(t, func(c wgbind.DERPConn) wgbind.DERPConn {
+		return wgbind.NewLossyConn(c, 0.3, 0, 0)
+	})
+	serveHello(t, server)
+
+	// Lost handshake packets are retried every 5s, lost TCP segments with
+	// backoff: keep asking until something gets through
+	httpClient := client.HTTPClient()
+	httpClient.Timeout = 20 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
+	defer cancel()
+
+	url := "http://" + net.JoinHostPort("10.0.0.1", "80") + "/"
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && string(body) == "hello" {
+				return
+			}
+			t.Logf("body %q, err %v", body, err)
+		} else {
+			t.Logf("request failed: %v", err)
+		}
+
+		if ctx.Err() != nil {
+			t.Fatal("no HTTP round trip at 30% loss")
+		}
+	}
+}
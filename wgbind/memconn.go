@@ -0,0 +1,90 @@
+package wgbind
+
+import (
+	"net"
+	"sync"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// memDERPQueueSize is how many packets a MemDERPConn holds for its reader.
+const memDERPQueueSize = 256
+
+// MemDERPConn is one end of an in-memory DERP connection, see NewMemDERPPair.
+type MemDERPConn struct {
+	self  key.NodePublic
+	peer  *MemDERPConn
+	inbox chan derp.ReceivedPacket
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ DERPConn = (*MemDERPConn)(nil)
+
+// NewMemDERPPair returns two connected DERPConns standing in for two clients
+// of the same DERP server, with public keys a and b. Together with LossyConn
+// this lets two DerpBinds (and the WireGuard devices on top) talk without a
+// network or a DERP server.
+//
+// A packet sent to the other end's key comes out of its Recv with the
+// sender's key as Source. Like a DERP server, packets for any other key, for
+// a closed end or for an end whose queue is full are dropped silently.
+func NewMemDERPPair(a, b key.NodePublic) (*MemDERPConn, *MemDERPConn) {
+	ca := &MemDERPConn{
+		self:  a,
+		inbox: make(chan derp.ReceivedPacket, memDERPQueueSize),
+		done:  make(chan struct{}),
+	}
+	cb := &MemDERPConn{
+		self:  b,
+		inbox: make(chan derp.ReceivedPacket, memDERPQueueSize),
+		done:  make(chan struct{}),
+	}
+	ca.peer, cb.peer = cb, ca
+	return ca, cb
+}
+
+// Send queues a copy of b for the other end if dstKey is its key.
+func (c *MemDERPConn) Send(dstKey key.NodePublic, b []byte) error {
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+
+	if dstKey != c.peer.self {
+		return nil
+	}
+
+	pkt := derp.ReceivedPacket{
+		Source: c.self,
+		Data:   append([]byte(nil), b...),
+	}
+	select {
+	case <-c.peer.done:
+	case c.peer.inbox <- pkt:
+	default:
+	}
+	return nil
+}
+
+// Recv returns the next packet from the other end, blocking until there is
+// one or this end is closed.
+func (c *MemDERPConn) Recv() (derp.ReceivedMessage, error) {
+	select {
+	case <-c.done:
+		return nil, net.ErrClosed
+	case pkt := <-c.inbox:
+		return pkt, nil
+	}
+}
+
+// Close closes this end. The other end stays open, its packets are dropped.
+func (c *MemDERPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
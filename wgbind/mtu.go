@@ -0,0 +1,96 @@
+package wgbind
+
+import (
+	"fmt"
+
+	"github.com/drio/spanza/frame"
+	"tailscale.com/derp"
+)
+
+// Transport identifies how WireGuard packets travel between peers,
+// for picking a tunnel MTU (see RecommendedMTU).
+type Transport int
+
+const (
+	TransportUDP           Transport = iota // Plain WireGuard over UDP
+	TransportDERP                           // DERP over TLS (native DERP client)
+	TransportDERPWebSocket                  // DERP over a WebSocket (browser/WASM)
+	TransportTCPStream                      // Length-prefixed frames over TCP (see the frame package)
+)
+
+// Per-packet overheads, in bytes.
+//
+// A tunnel packet of size MTU becomes a WireGuard transport message of
+// MTU + wireGuardOverhead bytes (type, receiver index, counter and the
+// Poly1305 tag). Each transport then wraps that message in its own headers.
+const (
+	linkMTU           = 1500 // Typical Ethernet path MTU
+	wireGuardOverhead = 32   // 4 type + 4 receiver + 8 counter + 16 tag
+	ipv6Header        = 40   // Assume IPv6, the larger IP header, like wg-quick does
+	udpHeader         = 8
+	tcpHeader         = 20
+	tlsRecordOverhead = 22 // TLS 1.3: 5 byte record header + 1 content type + 16 byte AEAD tag
+	derpFrameOverhead = 37 // 1 frame type + 4 frame length + 32 destination key
+	webSocketOverhead = 8  // 2 header + 2 extended length + 4 masking key (client frames)
+	streamFrameHeader = 4  // Length prefix (frame.HeaderSize)
+)
+
+// RecommendedMTU returns the tunnel MTU to configure for a transport.
+//
+// For UDP this is the usual WireGuard 1420 (1500 - 40 IPv6 - 8 UDP - 32 WireGuard).
+//
+// The TCP based transports never fragment at the IP level, but a WireGuard
+// packet split across two TCP segments has to wait for both of them, and a
+// single lost segment stalls everything behind it. Sizing the MTU so each
+// tunnel packet plus all framing fits in one segment avoids that:
+//
+//	DERP:           1500 - 40 IPv6 - 20 TCP - 22 TLS - 37 DERP - 32 WG     = 1349
+//	DERP/WebSocket: 1500 - 40 IPv6 - 20 TCP - 22 TLS - 8 WS - 37 DERP - 32 WG = 1341
+//	TCP stream:     1500 - 40 IPv6 - 20 TCP - 4 frame - 32 WG             = 1404
+func RecommendedMTU(t Transport) int {
+	switch t {
+	case TransportDERP:
+		return linkMTU - ipv6Header - tcpHeader - tlsRecordOverhead - derpFrameOverhead - wireGuardOverhead
+	case TransportDERPWebSocket:
+		return linkMTU - ipv6Header - tcpHeader - tlsRecordOverhead - webSocketOverhead - derpFrameOverhead - wireGuardOverhead
+	case TransportTCPStream:
+		return linkMTU - ipv6Header - tcpHeader - streamFrameHeader - wireGuardOverhead
+	default:
+		return linkMTU - ipv6Header - udpHeader - wireGuardOverhead
+	}
+}
+
+// Size limits for CheckMTU.
+const (
+	minMTU        = 576   // Smallest datagram every IPv4 host must accept
+	maxUDPPayload = 65507 // 65535 - 20 IPv4 - 8 UDP
+)
+
+// CheckMTU returns an error if tunnel packets of mtu bytes can't be carried
+// over t at all.
+//
+// Every transport caps the size of one WireGuard message (MTU + 32 bytes):
+// a UDP datagram's payload, a DERP packet (derp.MaxPacketSize) or a stream
+// frame (frame.MaxFrameSize). Over DERP a larger message is refused by the
+// client or dropped by the server, so the tunnel just loses every full-size
+// packet. MTUs between RecommendedMTU and these limits work, but may be slow.
+func CheckMTU(t Transport, mtu int) error {
+	if mtu < minMTU {
+		return fmt.Errorf("MTU %d is below the minimum of %d", mtu, minMTU)
+	}
+
+	var limit int
+	switch t {
+	case TransportDERP, TransportDERPWebSocket:
+		limit = derp.MaxPacketSize
+	case TransportTCPStream:
+		limit = frame.MaxFrameSize
+	default:
+		limit = maxUDPPayload
+	}
+	if mtu+wireGuardOverhead > limit {
+		return fmt.Errorf("MTU %d is too large: WireGuard messages would be %d bytes, the transport carries at most %d (use %d or less, %d recommended)",
+			mtu, mtu+wireGuardOverhead, limit, limit-wireGuardOverhead, RecommendedMTU(t))
+	}
+	return nil
+}
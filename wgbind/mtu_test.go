@@ -0,0 +1,67 @@
+package wgbind
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drio/spanza/frame"
+	"tailscale.com/derp"
+)
+
+func TestRecommendedMTU(t *testing.T) {
+	// The values documented on RecommendedMTU
+	want := map[Transport]int{
+		TransportUDP:           1420,
+		TransportDERP:          1349,
+		TransportDERPWebSocket: 1341,
+		TransportTCPStream:     1404,
+	}
+	for tr, mtu := range want {
+		if got := RecommendedMTU(tr); got != mtu {
+			t.Errorf("RecommendedMTU(%d) = %d, want %d", tr, got, mtu)
+		}
+	}
+
+	// Each transport costs exactly its framing compared to the others
+	udp := RecommendedMTU(TransportUDP)
+	if got := udp - RecommendedMTU(TransportTCPStream); got != tcpHeader+streamFrameHeader-udpHeader {
+		t.Errorf("UDP - TCP stream = %d, want TCP header + frame header - UDP header", got)
+	}
+	if got := RecommendedMTU(TransportTCPStream) - RecommendedMTU(TransportDERP); got != tlsRecordOverhead+derpFrameOverhead-streamFrameHeader {
+		t.Errorf("TCP stream - DERP = %d, want TLS + DERP frame - frame header", got)
+	}
+	if got := RecommendedMTU(TransportDERP) - RecommendedMTU(TransportDERPWebSocket); got != webSocketOverhead {
+		t.Errorf("DERP - DERP/WebSocket = %d, want %d", got, webSocketOverhead)
+	}
+}
+
+func TestCheckMTU(t *testing.T) {
+	tests := []struct {
+		transport Transport
+		mtu       int
+		wantErr   string // "" if accepted
+	}{
+		{TransportUDP, 1420, ""},
+		{TransportUDP, minMTU, ""},
+		{TransportUDP, minMTU - 1, "below the minimum"},
+		{TransportUDP, maxUDPPayload - wireGuardOverhead, ""},
+		{TransportUDP, maxUDPPayload - wireGuardOverhead + 1, "too large"},
+		{TransportDERP, 1349, ""},
+		{TransportDERP, derp.MaxPacketSize - wireGuardOverhead, ""},
+		{TransportDERP, derp.MaxPacketSize - wireGuardOverhead + 1, "too large"},
+		{TransportDERPWebSocket, 1341, ""},
+		{TransportDERPWebSocket, 0, "below the minimum"},
+		{TransportTCPStream, 1404, ""},
+		{TransportTCPStream, frame.MaxFrameSize - wireGuardOverhead, ""},
+		{TransportTCPStream, frame.MaxFrameSize - wireGuardOverhead + 1, "too large"},
+	}
+	for _, tt := range tests {
+		err := CheckMTU(tt.transport, tt.mtu)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("CheckMTU(%d, %d) = %v, want accepted", tt.transport, tt.mtu, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("CheckMTU(%d, %d) = %v, want an error containing %q", tt.transport, tt.mtu, err, tt.wantErr)
+		}
+	}
+}
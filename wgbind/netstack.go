@@ -1,11 +1,12 @@
 package wgbind
 
 import (
-	"log"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 
+	"github.com/drio/spanza/logging"
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/tun/netstack"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -16,25 +17,66 @@ import (
 //
 // Unlike StdNetBind which uses kernel UDP (net.ListenUDP), NetstackBind uses
 // the userspace network stack (tnet.ListenUDP) from netstack.
+//
+// A single conn serves every peer: Send routes by the endpoint's dst and
+// receive stamps each packet with its own source, so any number of WireGuard
+// peers can share one bind. conn is an atomic pointer so the hot paths (Send
+// from WireGuard's per-peer goroutines, receive from each receiver) never
+// take mu, which only serializes Open and Close.
 type NetstackBind struct {
-	mu       sync.Mutex
-	tnet     *netstack.Net
-	conn     *gonet.UDPConn
-	localIP  netip.Addr      // Local IP address for this bind
-	localPort uint16         // Local port for this bind
+	mu        sync.Mutex
+	tnet      *netstack.Net
+	conn      atomic.Pointer[gonet.UDPConn]
+	localIP   netip.Addr // Local IP address for this bind
+	receivers int        // Number of receive functions returned by Open
+	logger    logging.Logger
 }
 
 var _ conn.Bind = (*NetstackBind)(nil)
 
+// NetstackBindOption configures optional NetstackBind behavior.
+type NetstackBindOption func(*NetstackBind)
+
+// WithReceivers makes Open return n receive functions instead of one.
+//
+// WireGuard runs one goroutine per receive function, so with n > 1 reads
+// from the UDP conn happen in parallel. Only the reads: wireguard-go already
+// decrypts in its own pool of workers (one per CPU) whatever the number of
+// receivers, so this helps when reading packets off the userspace stack is
+// the bottleneck. All receivers read from the same UDP conn, which is safe
+// for concurrent use, and each packet gets its own endpoint, so the source
+// stamping is unaffected.
+func WithReceivers(n int) NetstackBindOption {
+	return func(b *NetstackBind) {
+		if n > 0 {
+			b.receivers = n
+		}
+	}
+}
+
+// WithNetstackLogger sets where the bind logs (default: the standard log
+// package, without the per-packet debug lines).
+func WithNetstackLogger(l logging.Logger) NetstackBindOption {
+	return func(b *NetstackBind) {
+		b.logger = l
+	}
+}
+
 // NewNetstackBind creates a new Bind that uses userspace UDP from the provided
 // netstack.Net. The tnet parameter comes from netstack.CreateNetTUN().
 // The localIP parameter specifies the local IP address to use (e.g., "192.168.4.2").
-func NewNetstackBind(tnet *netstack.Net, localIP string) conn.Bind {
+func NewNetstackBind(tnet *netstack.Net, localIP string, opts ...NetstackBindOption) conn.Bind {
 	ip, _ := netip.ParseAddr(localIP)
-	return &NetstackBind{
-		tnet:    tnet,
-		localIP: ip,
+	b := &NetstackBind{
+		tnet:      tnet,
+		localIP:   ip,
+		receivers: 1,
+		logger:    logging.Std("[wgbind]", false),
+	}
+	for _, opt := range opts {
+		opt(b)
 	}
+	return b
 }
 
 // NetstackEndpoint represents a UDP endpoint for the netstack bind.
@@ -75,13 +117,20 @@ func (b *NetstackBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if b.conn != nil {
+	if b.conn.Load() != nil {
 		return nil, 0, conn.ErrBindAlreadyOpen
 	}
 
-	// Listen on all interfaces within the userspace network
+	// Listen on all interfaces within the userspace network, in the address
+	// family of our address (netstack sockets are single-family). Netstack
+	// only treats the IPv4 wildcard as one, binding "::" fails with "bad
+	// local address", so IPv6 binds to our own address.
+	ip := net.IPv4zero
+	if b.localIP.Is6() {
+		ip = net.IP(b.localIP.AsSlice())
+	}
 	addr := &net.UDPAddr{
-		IP:   net.IPv4zero,
+		IP:   ip,
 		Port: int(port),
 	}
 
@@ -90,33 +139,34 @@ func (b *NetstackBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
 		return nil, 0, err
 	}
 
-	b.conn = udpConn
-
 	// Get the actual port we bound to and extract local address
 	localAddr := udpConn.LocalAddr().(*net.UDPAddr)
 	actualPort := uint16(localAddr.Port)
-	b.localPort = actualPort
+	src := netip.AddrPortFrom(b.localIP, actualPort)
 
-	log.Printf("[wgbind] Bound to %s:%d", b.localIP, actualPort)
+	b.conn.Store(udpConn)
 
-	// Return a single receive function
+	b.logger.Infof("Bound to %s (%d receivers)", src, b.receivers)
+
+	// One receive function per receiver, all reading from the same conn.
+	// They capture this Open's conn and source rather than reading the
+	// bind's fields, so receivers left over from a previous Open fail on
+	// their closed conn instead of racing with the new one.
 	recvFn := func(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
-		return b.receive(bufs, sizes, eps)
+		return receive(udpConn, src, b.logger, bufs, sizes, eps)
 	}
 
-	return []conn.ReceiveFunc{recvFn}, actualPort, nil
-}
-
-// receive reads packets from the UDP connection.
-func (b *NetstackBind) receive(bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
-	b.mu.Lock()
-	udpConn := b.conn
-	b.mu.Unlock()
-
-	if udpConn == nil {
-		return 0, net.ErrClosed
+	fns := make([]conn.ReceiveFunc, b.receivers)
+	for i := range fns {
+		fns[i] = recvFn
 	}
 
+	return fns, actualPort, nil
+}
+
+// receive reads packets from udpConn. src is the local address stamped on
+// every endpoint.
+func receive(udpConn *gonet.UDPConn, src netip.AddrPort, logger logging.Logger, bufs [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
 	// Simple implementation: read one packet at a time
 	// WireGuard will call this repeatedly as needed
 	n, addr, err := udpConn.ReadFrom(bufs[0])
@@ -136,16 +186,15 @@ func (b *NetstackBind) receive(bufs [][]byte, sizes []int, eps []conn.Endpoint)
 	// This becomes the DESTINATION for our replies (dst)
 	dstAddrPort := udpAddr.AddrPort()
 
-	// For source, use our configured local address
-	srcAddrPort := netip.AddrPortFrom(b.localIP, b.localPort)
-
+	// A fresh endpoint per packet: WireGuard keeps it as the peer's
+	// endpoint (roaming), so it must not be shared between peers
 	eps[0] = &NetstackEndpoint{
 		dst: dstAddrPort,
-		src: srcAddrPort,
+		src: src,
 	}
 
-	log.Printf("[wgbind] Received %d bytes from %s", n, dstAddrPort)
-	log.Printf("[wgbind] Endpoint - Src: %s, Dst: %s", srcAddrPort, dstAddrPort)
+	logger.Debugf("Received %d bytes from %s", n, dstAddrPort)
+	logger.Debugf("Endpoint - Src: %s, Dst: %s", src, dstAddrPort)
 
 	return 1, nil
 }
@@ -155,21 +204,17 @@ func (b *NetstackBind) Close() error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if b.conn == nil {
+	udpConn := b.conn.Swap(nil)
+	if udpConn == nil {
 		return nil
 	}
-
-	err := b.conn.Close()
-	b.conn = nil
-	return err
+	return udpConn.Close()
 }
 
 // Send writes packets to the specified endpoint.
+// It is called concurrently, once per peer, and only reads shared state.
 func (b *NetstackBind) Send(bufs [][]byte, endpoint conn.Endpoint) error {
-	b.mu.Lock()
-	udpConn := b.conn
-	b.mu.Unlock()
-
+	udpConn := b.conn.Load()
 	if udpConn == nil {
 		return net.ErrClosed
 	}
@@ -187,9 +232,13 @@ func (b *NetstackBind) Send(bufs [][]byte, endpoint conn.Endpoint) error {
 	for _, buf := range bufs {
 		n, err := udpConn.WriteTo(buf, addr)
 		if err != nil {
+			// Close (or a reopen) swapped out the conn while we were using it
+			if b.conn.Load() != udpConn {
+				return net.ErrClosed
+			}
 			return err
 		}
-		log.Printf("[wgbind] Sent %d bytes to %s", n, addr)
+		b.logger.Debugf("Sent %d bytes to %s", n, addr)
 	}
 
 	return nil
@@ -0,0 +1,366 @@
+package wgbind_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drio/spanza/tunnel"
+	"github.com/drio/spanza/wgbind"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// Both ends of the outer (userspace) network share one address
+const (
+	outerIP         = "10.1.0.1"
+	serverOuterPort = 51820
+	clientOuterPort = 51821
+)
+
+// newNetstackTunnels connects two tunnels (10.0.0.1 and 10.0.0.2) whose
+// WireGuard packets travel as UDP over one shared userspace network, through
+// NetstackBinds with the given number of receivers.
+func newNetstackTunnels(tb testing.TB, receivers int) (server, client *tunnel.Tunnel) {
+	tb.Helper()
+
+	_, outer, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr(outerIP)}, nil, 1500)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	serverPriv, serverPub := newWireGuardKeys(tb)
+	clientPriv, clientPub := newWireGuardKeys(tb)
+
+	server, err = tunnel.New(tunnel.Config{
+		LocalIP:    "10.0.0.1",
+		PrivateKey: serverPriv,
+		ListenPort: serverOuterPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey:  clientPub,
+			AllowedIPs: []string{"10.0.0.2/32"},
+		},
+		Bind: wgbind.NewNetstackBind(outer, outerIP,
+			wgbind.WithReceivers(receivers), wgbind.WithNetstackLogger(nopLogger{})),
+	})
+	if err != nil {
+		tb.Fatalf("server tunnel: %v", err)
+	}
+	tb.Cleanup(func() { server.Close() })
+
+	client, err = tunnel.New(tunnel.Config{
+		LocalIP:    "10.0.0.2",
+		PrivateKey: clientPriv,
+		ListenPort: clientOuterPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey: serverPub,
+			Endpoint:  fmt.Sprintf("%s:%d", outerIP, serverOuterPort),
+		},
+		Bind: wgbind.NewNetstackBind(outer, outerIP,
+			wgbind.WithReceivers(receivers), wgbind.WithNetstackLogger(nopLogger{})),
+	})
+	if err != nil {
+		tb.Fatalf("client tunnel: %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+
+	return server, client
+}
+
+// serveSink accepts connections on port 9 of tun and sends what each one
+// read to got.
+func serveSink(tb testing.TB, tun *tunnel.Tunnel, got chan<- []byte) {
+	tb.Helper()
+	ln, err := tun.ListenTCP(9)
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				data, _ := io.ReadAll(c)
+				got <- data
+			}()
+		}
+	}()
+}
+
+// send writes data to the sink on 10.0.0.1 through tun.
+func send(tun *tunnel.Tunnel, data []byte) error {
+	c, err := tun.DialContext(context.Background(), "tcp", net.JoinHostPort("10.0.0.1", "9"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(data)
+	return err
+}
+
+func TestNetstackBindParallelReceivers(t *testing.T) {
+	server, client := newNetstackTunnels(t, 4)
+
+	got := make(chan []byte)
+	serveSink(t, server, got)
+
+	// Several streams at once, so the receivers really share the traffic
+	// and hand WireGuard packets out of order
+	const streams = 4
+	want := make(map[string]bool)
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		data := make([]byte, 256<<10)
+		rand.Read(data)
+		want[string(data)] = true
+		go func() { errs <- send(client, data) }()
+	}
+
+	for i := 0; i < streams; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	for i := 0; i < streams; i++ {
+		data := <-got
+		if !want[string(data)] {
+			t.Fatalf("stream %d: got %d bytes that weren't sent intact", i, len(data))
+		}
+		delete(want, string(data))
+	}
+}
+
+func BenchmarkNetstackBindReceive(b *testing.B) {
+	for _, receivers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("receivers=%d", receivers), func(b *testing.B) {
+			server, client := newNetstackTunnels(b, receivers)
+
+			got := make(chan []byte)
+			serveSink(b, server, got)
+
+			data := bytes.Repeat([]byte("x"), 1<<20)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := send(client, data); err != nil {
+					b.Fatal(err)
+				}
+				if n := len(<-got); n != len(data) {
+					b.Fatalf("received %d bytes, want %d", n, len(data))
+				}
+			}
+		})
+	}
+}
+
+// newOuterNet returns a userspace network with outerIP, for binds and the
+// plain UDP sockets standing in for their peers.
+func newOuterNet(tb testing.TB) *netstack.Net {
+	tb.Helper()
+	_, outer, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr(outerIP)}, nil, 1500)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return outer
+}
+
+func TestNetstackBindTwoPeers(t *testing.T) {
+	outer := newOuterNet(t)
+	bind := wgbind.NewNetstackBind(outer, outerIP, wgbind.WithNetstackLogger(nopLogger{}))
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	bindAddr := &net.UDPAddr{IP: net.ParseIP(outerIP), Port: int(port)}
+
+	// Two peers, each sending to the bind and expecting its own packets back
+	const packets = 100
+	peers := make([]net.PacketConn, 2)
+	eps := make([]conn.Endpoint, 2)
+	for i := range peers {
+		peerPort := 52000 + i
+		pc, err := outer.ListenUDP(&net.UDPAddr{Port: peerPort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		peers[i] = pc
+		if eps[i], err = bind.ParseEndpoint(fmt.Sprintf("%s:%d", outerIP, peerPort)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, pc := range peers {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < packets; n++ {
+				if _, err := pc.WriteTo([]byte{byte(i)}, bindAddr); err != nil {
+					t.Errorf("peer %d: %v", i, err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < packets; n++ {
+				if err := bind.Send([][]byte{{byte(i)}}, eps[i]); err != nil {
+					t.Errorf("send to peer %d: %v", i, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Every packet the bind receives carries its sender as the endpoint
+	buf := [][]byte{make([]byte, 64)}
+	sizes := make([]int, 1)
+	recvEps := make([]conn.Endpoint, 1)
+	for n := 0; n < 2*packets; n++ {
+		if _, err := fns[0](buf, sizes, recvEps); err != nil {
+			t.Fatal(err)
+		}
+		from := buf[0][0]
+		if got, want := recvEps[0].DstToString(), eps[from].DstToString(); got != want {
+			t.Fatalf("packet from peer %d has endpoint %s, want %s", from, got, want)
+		}
+	}
+
+	// And each peer gets only the packets sent to it
+	for i, pc := range peers {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 64)
+		for n := 0; n < packets; n++ {
+			size, _, err := pc.ReadFrom(b)
+			if err != nil {
+				t.Fatalf("peer %d, packet %d: %v", i, n, err)
+			}
+			if size != 1 || b[0] != byte(i) {
+				t.Fatalf("peer %d got a packet for peer %d", i, b[0])
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// TestNetstackBindConcurrentSend hammers Send from many goroutines while
+// the bind is closed and reopened; run with -race.
+func TestNetstackBindConcurrentSend(t *testing.T) {
+	outer := newOuterNet(t)
+	bind := wgbind.NewNetstackBind(outer, outerIP, wgbind.WithNetstackLogger(nopLogger{}))
+	if _, _, err := bind.Open(0); err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	ep, err := bind.ParseEndpoint(fmt.Sprintf("%s:%d", outerIP, 52100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Fails with net.ErrClosed while the bind is closed
+				if err := bind.Send([][]byte{[]byte("packet")}, ep); err != nil && !errors.Is(err, net.ErrClosed) {
+					t.Errorf("Send: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		time.Sleep(5 * time.Millisecond)
+		bind.Close()
+		if _, _, err := bind.Open(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// TestNetstackBindIPv6 runs two peers on IPv6 ULA addresses, both inside the
+// tunnel and on the outer network, and makes an HTTP request between them.
+func TestNetstackBindIPv6(t *testing.T) {
+	const outerIP6 = "fd01::1"
+	_, outer, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr(outerIP6)}, nil, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverPriv, serverPub := newWireGuardKeys(t)
+	clientPriv, clientPub := newWireGuardKeys(t)
+
+	server, err := tunnel.New(tunnel.Config{
+		LocalIP:    "fd00::1",
+		PrivateKey: serverPriv,
+		ListenPort: serverOuterPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey:  clientPub,
+			AllowedIPs: []string{"fd00::2/128"},
+		},
+		Bind: wgbind.NewNetstackBind(outer, outerIP6, wgbind.WithNetstackLogger(nopLogger{})),
+	})
+	if err != nil {
+		t.Fatalf("server tunnel: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err := tunnel.New(tunnel.Config{
+		LocalIP:    "fd00::2",
+		PrivateKey: clientPriv,
+		ListenPort: clientOuterPort,
+		Peer: tunnel.PeerConfig{
+			PublicKey: serverPub,
+			Endpoint:  net.JoinHostPort(outerIP6, fmt.Sprint(serverOuterPort)),
+		},
+		Bind: wgbind.NewNetstackBind(outer, outerIP6, wgbind.WithNetstackLogger(nopLogger{})),
+	})
+	if err != nil {
+		t.Fatalf("client tunnel: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	serveHello(t, server)
+
+	httpClient := client.HTTPClient()
+	httpClient.Timeout = 10 * time.Second
+	resp, err := httpClient.Get("http://" + net.JoinHostPort("fd00::1", "80") + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want %q", body, "hello")
+	}
+}
@@ -0,0 +1,40 @@
+package wgbind
+
+import "sync"
+
+// recvBufSize covers any WireGuard message at the tunnel MTUs we use
+// (1420 + 32 bytes of WireGuard overhead). Larger packets get a one-off
+// allocation.
+const recvBufSize = 2048
+
+// recvBufPool holds the buffers the DERP receive loop copies packets into
+// before queuing them. receiveDERP returns them once WireGuard has its copy.
+//
+// The copy itself can't be avoided: derp.ReceivedPacket.Data points into the
+// DERP client's read buffer and is only valid until the next Recv.
+var recvBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, recvBufSize)
+		return &buf
+	},
+}
+
+// getRecvBuf returns a buffer of length n, pooled when n fits.
+func getRecvBuf(n int) *[]byte {
+	if n > recvBufSize {
+		buf := make([]byte, n)
+		return &buf
+	}
+	buf := recvBufPool.Get().(*[]byte)
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putRecvBuf hands a buffer from getRecvBuf back to the pool.
+func putRecvBuf(buf *[]byte) {
+	if cap(*buf) != recvBufSize {
+		return
+	}
+	*buf = (*buf)[:recvBufSize]
+	recvBufPool.Put(buf)
+}
@@ -0,0 +1,42 @@
+package wgbind
+
+import (
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// BenchmarkReceivePath measures the per-packet work between the DERP client
+// and WireGuard's buffer: the copy out of the client's read buffer, the
+// hand-off through the receive queue and deliver. Compare the allocations
+// of the pooled copy buffer with a fresh one per packet.
+func BenchmarkReceivePath(b *testing.B) {
+	packet := make([]byte, 1420+wireGuardOverhead)
+
+	for _, bench := range []struct {
+		name   string
+		getBuf func(n int) *[]byte
+	}{
+		{"pooled", getRecvBuf},
+		{"unpooled", func(n int) *[]byte {
+			buf := make([]byte, n)
+			return &buf
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			bind := NewDerpBind(newFakeConn(), testPeer, WithLogger(nopLogger{}))
+			buffs := [][]byte{make([]byte, 2048)}
+			sizes := make([]int, 1)
+			eps := make([]conn.Endpoint, 1)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			for i := 0; i < b.N; i++ {
+				data := bench.getBuf(len(packet))
+				copy(*data, packet)
+				bind.recvCh <- derpPacket{data: data, from: testPeer, received: bind.clock.Now()}
+				bind.deliver(<-bind.recvCh, buffs, sizes, eps, 0)
+			}
+		})
+	}
+}
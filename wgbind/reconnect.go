@@ -0,0 +1,59 @@
+package wgbind
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WithDialer sets how DerpBind creates a replacement DERP client, for
+// Reconnect. WithIdleDisconnect sets one too.
+func WithDialer(dial func() (DERPConn, error)) DerpBindOption {
+	return func(b *DerpBind) {
+		b.dial = dial
+	}
+}
+
+// Reconnect replaces the DERP connection with a freshly dialed one, without
+// touching the WireGuard device using the bind.
+//
+// Meant for network changes (a laptop waking up, switching Wi-Fi) where the
+// old connection is dead but may take a long time to fail on its own.
+// WireGuard's next handshake or keepalive then goes over the new connection.
+// Requires a dialer (see WithDialer).
+func (b *DerpBind) Reconnect() error {
+	if b.dial == nil {
+		return errors.New("no DERP dialer configured")
+	}
+
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return errors.New("bind is closed")
+	}
+
+	b.logger.Infof("Reconnecting to DERP...")
+	client, err := b.dial()
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to DERP: %w", err)
+	}
+
+	b.clientMu.Lock()
+	old := b.derpClient
+	b.derpClient = client
+	b.clientMu.Unlock()
+	b.lastActive.Store(b.clock.Now().UnixNano())
+
+	// The receive loop notices its client was swapped when the old Recv
+	// fails, or wakes up here if it was parked without a client
+	if old != nil {
+		old.Close()
+	}
+	select {
+	case b.clientReady <- struct{}{}:
+	default:
+	}
+
+	b.logger.Infof("✓ Reconnected to DERP")
+	return nil
+}
@@ -0,0 +1,59 @@
+package wgbind
+
+import (
+	"testing"
+
+	"tailscale.com/derp"
+)
+
+func TestReconnect(t *testing.T) {
+	first, second := newFakeConn(), newFakeConn()
+	dial := func() (DERPConn, error) { return second, nil }
+	b := newTestBind(t, first, WithDialer(dial))
+
+	// The receive loop is running on the first connection
+	first.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("before")}
+	if data, _ := receiveOne(t, b); string(data) != "before" {
+		t.Fatalf("received %q, want %q", data, "before")
+	}
+
+	if err := b.Reconnect(); err != nil {
+		t.Fatalf("Reconnect: %v", err)
+	}
+	if !first.isClosed() {
+		t.Error("old connection not closed")
+	}
+
+	// Both directions use the new connection
+	ep, _ := b.ParseEndpoint("")
+	if err := b.Send([][]byte{[]byte("out")}, ep); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case pkt := <-second.sent:
+		if string(pkt) != "out" {
+			t.Errorf("sent %q, want %q", pkt, "out")
+		}
+	default:
+		t.Error("packet not sent on the new connection")
+	}
+
+	second.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("after")}
+	if data, _ := receiveOne(t, b); string(data) != "after" {
+		t.Errorf("received %q, want %q", data, "after")
+	}
+}
+
+func TestReconnectErrors(t *testing.T) {
+	b := newTestBind(t, newFakeConn())
+	if err := b.Reconnect(); err == nil {
+		t.Error("Reconnect without a dialer succeeded")
+	}
+
+	dial := func() (DERPConn, error) { return newFakeConn(), nil }
+	b = newTestBind(t, newFakeConn(), WithDialer(dial))
+	b.Close()
+	if err := b.Reconnect(); err == nil {
+		t.Error("Reconnect on a closed bind succeeded")
+	}
+}
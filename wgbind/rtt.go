@@ -0,0 +1,109 @@
+package wgbind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rttHistorySize is how many DERP round-trip samples DerpBind keeps.
+const rttHistorySize = 10
+
+// derpPinger is implemented by DERP clients that can ping the DERP server,
+// like *derphttp.Client. The pong is only seen while something is calling
+// Recv, which DerpBind's receive loop does.
+type derpPinger interface {
+	Ping(ctx context.Context) error
+}
+
+// WithRTTProbe makes the bind ping the DERP server every interval once
+// opened, recording the round-trip time (see RTT).
+func WithRTTProbe(interval time.Duration) DerpBindOption {
+	return func(b *DerpBind) {
+		b.rttInterval = interval
+	}
+}
+
+// RTT returns the latest round-trip time to the DERP server and the recent
+// samples, oldest first. Both are zero/empty until a probe has succeeded.
+func (b *DerpBind) RTT() (latest time.Duration, history []time.Duration) {
+	b.rttMu.Lock()
+	defer b.rttMu.Unlock()
+
+	if len(b.rttHistory) == 0 {
+		return 0, nil
+	}
+	history = append([]time.Duration(nil), b.rttHistory...)
+	return history[len(history)-1], history
+}
+
+// Ping measures one round trip to the DERP server and records it (see RTT).
+//
+// DERP pings are answered by the server, they are never forwarded to the
+// peer, so this is the first leg of the relay path only. A packet to the peer
+// also crosses the peer's own leg to the server. The bind must be open, the
+// pong arrives through its receive loop.
+func (b *DerpBind) Ping(timeout time.Duration) (time.Duration, error) {
+	client := b.client()
+	if client == nil {
+		return 0, errors.New("not connected to DERP")
+	}
+	pinger, ok := client.(derpPinger)
+	if !ok {
+		return 0, fmt.Errorf("DERP client %T can't ping", client)
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, timeout)
+	defer cancel()
+
+	start := b.clock.Now()
+	if err := pinger.Ping(ctx); err != nil {
+		return 0, fmt.Errorf("DERP ping failed: %w", err)
+	}
+	rtt := b.clock.Now().Sub(start)
+	b.recordRTT(rtt)
+	return rtt, nil
+}
+
+// recordRTT adds a round-trip sample, keeping the last rttHistorySize.
+func (b *DerpBind) recordRTT(rtt time.Duration) {
+	b.rttMu.Lock()
+	defer b.rttMu.Unlock()
+
+	b.rttHistory = append(b.rttHistory, rtt)
+	if len(b.rttHistory) > rttHistorySize {
+		b.rttHistory = b.rttHistory[len(b.rttHistory)-rttHistorySize:]
+	}
+}
+
+// rttLoop pings the DERP server every interval until the bind is closed.
+func (b *DerpBind) rttLoop(interval time.Duration) {
+	for {
+		if !b.sleep(interval) {
+			return
+		}
+
+		// Nothing to measure while disconnected for idleness
+		client := b.client()
+		if client == nil {
+			continue
+		}
+
+		pinger, ok := client.(derpPinger)
+		if !ok {
+			b.logger.Infof("DERP client %T can't ping, RTT probe disabled", client)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+		start := b.clock.Now()
+		err := pinger.Ping(ctx)
+		cancel()
+		if err != nil {
+			b.logger.Errorf("DERP ping failed: %v", err)
+			continue
+		}
+		b.recordRTT(b.clock.Now().Sub(start))
+	}
+}
@@ -0,0 +1,65 @@
+package wgbind
+
+import (
+	"testing"
+	"time"
+)
+
+// rttTolerance is how much slower than the fake DERP server's delay a
+// measured round trip may be (scheduling, a loaded CI machine).
+const rttTolerance = 100 * time.Millisecond
+
+func TestPingMeasuresRTT(t *testing.T) {
+	conn := newFakeConn()
+	conn.pingDelay = 50 * time.Millisecond
+	b := newTestBind(t, conn)
+
+	rtt, err := b.Ping(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < conn.pingDelay || rtt > conn.pingDelay+rttTolerance {
+		t.Errorf("RTT = %s, want %s (+%s)", rtt, conn.pingDelay, rttTolerance)
+	}
+
+	latest, history := b.RTT()
+	if latest != rtt || len(history) != 1 {
+		t.Errorf("RTT() = %s, %v, want %s, [%s]", latest, history, rtt, rtt)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	conn := newFakeConn()
+	conn.pingDelay = time.Second
+	b := newTestBind(t, conn)
+
+	if _, err := b.Ping(50 * time.Millisecond); err == nil {
+		t.Fatal("Ping succeeded past its timeout")
+	}
+	if latest, _ := b.RTT(); latest != 0 {
+		t.Errorf("failed ping recorded an RTT of %s", latest)
+	}
+}
+
+func TestRTTProbe(t *testing.T) {
+	conn := newFakeConn()
+	conn.pingDelay = 20 * time.Millisecond
+	b := newTestBind(t, conn, WithRTTProbe(10*time.Millisecond))
+
+	// Probes keep coming, the history keeps the last rttHistorySize
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, history := b.RTT(); len(history) == rttHistorySize {
+			for _, rtt := range history {
+				if rtt < conn.pingDelay || rtt > conn.pingDelay+rttTolerance {
+					t.Errorf("probe RTT = %s, want %s (+%s)", rtt, conn.pingDelay, rttTolerance)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("RTT history never filled up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,104 @@
+package wgbind
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSendTimeout is returned by Send when the DERP client didn't take the
+// packets within the send timeout (see WithSendTimeout).
+var ErrSendTimeout = errors.New("DERP send timed out")
+
+// WithSendTimeout makes Send give up after d if the DERP client is still
+// blocked writing, returning ErrSendTimeout to WireGuard.
+//
+// A DERP client blocks when its connection stops draining (a full WebSocket
+// buffer, a dead TCP connection that hasn't timed out yet), and WireGuard
+// calls Send from its own goroutines, so without a timeout the whole device
+// stalls behind it. While a timed out send is still stuck, further sends
+// fail right away. If the bind has a dialer (WithDialer, WithIdleDisconnect
+// or NewDerpBindFromConfig) a timeout also triggers Reconnect, which closes
+// the stuck connection.
+//
+// Packets are copied before sending so WireGuard can reuse its buffers as
+// soon as Send returns.
+func WithSendTimeout(d time.Duration) DerpBindOption {
+	return func(b *DerpBind) {
+		b.sendTimeout = d
+	}
+}
+
+// SendTimeouts returns how many sends gave up because the DERP client was
+// blocked (see WithSendTimeout).
+func (b *DerpBind) SendTimeouts() uint64 {
+	return b.sendTimeouts.Load()
+}
+
+// Send states, for sendWithTimeout.
+const (
+	sendRunning int32 = iota
+	sendFinished
+	sendAbandoned // Timed out, counted in stuckSends until it finishes
+)
+
+// sendWithTimeout sends buffs to the remote peer through client, waiting at
+// most b.sendTimeout for it.
+func (b *DerpBind) sendWithTimeout(client DERPConn, buffs [][]byte) error {
+	if b.stuckSends.Load() > 0 {
+		return ErrSendTimeout
+	}
+
+	// The send may outlive this call, so it can't use WireGuard's buffers
+	pkts := make([]*[]byte, 0, len(buffs))
+	for _, buff := range buffs {
+		if len(buff) == 0 {
+			continue
+		}
+		pkt := getRecvBuf(len(buff))
+		copy(*pkt, buff)
+		pkts = append(pkts, pkt)
+	}
+
+	// Whichever of the send and the timeout comes first decides: a send
+	// that finishes after being abandoned takes itself out of stuckSends,
+	// and only its own, so other sends finishing don't clear it
+	var state atomic.Int32
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for _, pkt := range pkts {
+			if err == nil {
+				err = client.Send(b.remotePubKey, *pkt)
+			}
+			putRecvBuf(pkt)
+		}
+		if !state.CompareAndSwap(sendRunning, sendFinished) {
+			b.stuckSends.Add(-1) // The client is moving again
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-b.clock.After(b.sendTimeout):
+	}
+	if !state.CompareAndSwap(sendRunning, sendAbandoned) {
+		return <-done // Finished just in time
+	}
+	stuck := b.stuckSends.Add(1)
+
+	b.sendTimeouts.Add(1)
+	b.logger.Errorf("DERP send blocked for %s, giving up", b.sendTimeout)
+
+	// Concurrent sends stuck on the same connection need one reconnect
+	if b.dial != nil && stuck == 1 {
+		go func() {
+			if err := b.Reconnect(); err != nil {
+				b.logger.Errorf("%v", err)
+			}
+		}()
+	}
+	return ErrSendTimeout
+}
@@ -0,0 +1,88 @@
+package wgbind
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// stuckConn is a DERPConn whose sends block until release is closed, even
+// after Close, like a client wedged on a dead connection.
+type stuckConn struct {
+	*fakeConn
+	sends   atomic.Int32
+	release chan struct{}
+}
+
+func (c *stuckConn) Send(dstKey key.NodePublic, b []byte) error {
+	c.sends.Add(1)
+	<-c.release
+	return c.fakeConn.Send(dstKey, b)
+}
+
+func TestSendTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	stuck := &stuckConn{fakeConn: newFakeConn(), release: make(chan struct{})}
+
+	var dials atomic.Int32
+	fresh := newFakeConn()
+	dial := func() (DERPConn, error) {
+		dials.Add(1)
+		return fresh, nil
+	}
+	b := newTestBind(t, stuck, WithSendTimeout(timeout), WithDialer(dial))
+	ep, _ := b.ParseEndpoint("")
+	packet := [][]byte{[]byte("packet")}
+
+	if err := b.Send(packet, ep); !errors.Is(err, ErrSendTimeout) {
+		t.Fatalf("blocked Send: err = %v, want ErrSendTimeout", err)
+	}
+
+	// While that send is stuck, the next one fails without waiting
+	start := time.Now()
+	if err := b.Send(packet, ep); !errors.Is(err, ErrSendTimeout) {
+		t.Errorf("next Send: err = %v, want ErrSendTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed >= timeout {
+		t.Errorf("next Send took %s, want a fast failure", elapsed)
+	}
+	if n := stuck.sends.Load(); n != 1 {
+		t.Errorf("client got %d sends, want only the stuck one", n)
+	}
+
+	// The timeout reconnected, once
+	deadline := time.Now().Add(5 * time.Second)
+	for b.client() != DERPConn(fresh) {
+		if time.Now().After(deadline) {
+			t.Fatal("no reconnect after the timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("reconnected %d times, want 1", n)
+	}
+	if got := b.SendTimeouts(); got != 1 {
+		t.Errorf("SendTimeouts = %d, want 1", got)
+	}
+
+	// Once the stuck send gives up, sends go through on the new connection
+	close(stuck.release)
+	deadline = time.Now().Add(5 * time.Second)
+	for b.stuckSends.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stuck send never cleared")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Send(packet, ep); err != nil {
+		t.Fatalf("Send after recovery: %v", err)
+	}
+	select {
+	case <-fresh.sent:
+	default:
+		t.Error("packet not sent on the new connection")
+	}
+}
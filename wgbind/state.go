@@ -0,0 +1,55 @@
+package wgbind
+
+// stateQueueSize is how many connection state changes can wait for a slow
+// callback before further ones are dropped.
+const stateQueueSize = 16
+
+// WithStateCallbacks calls onConnect when the DERP connection comes up
+// (the first successful receive) and onDisconnect when it is lost. Either
+// may be nil.
+//
+// The callbacks run on their own goroutine, in order, so a slow handler
+// can't stall the receive loop.
+func WithStateCallbacks(onConnect, onDisconnect func()) DerpBindOption {
+	return func(b *DerpBind) {
+		b.onConnect = onConnect
+		b.onDisconnect = onDisconnect
+		b.stateCh = make(chan bool, stateQueueSize)
+	}
+}
+
+// Connected reports whether the DERP connection is currently up, as seen
+// by the receive loop.
+func (b *DerpBind) Connected() bool {
+	return b.connected.Load()
+}
+
+// setConnected records the connection state and queues the matching
+// callback if it changed.
+func (b *DerpBind) setConnected(up bool) {
+	if b.connected.Swap(up) == up || b.stateCh == nil {
+		return
+	}
+
+	select {
+	case b.stateCh <- up:
+	default:
+		b.logger.Errorf("WARNING: State callbacks too slow, dropping state change (connected=%v)", up)
+	}
+}
+
+// stateLoop runs the state callbacks until the bind is closed.
+func (b *DerpBind) stateLoop() {
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case up := <-b.stateCh:
+			if up && b.onConnect != nil {
+				b.onConnect()
+			} else if !up && b.onDisconnect != nil {
+				b.onDisconnect()
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package wgbind
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+)
+
+func TestStateCallbacks(t *testing.T) {
+	states := make(chan string, 4)
+	release := make(chan struct{})
+	onConnect := func() {
+		states <- "connected"
+		<-release // A slow handler
+	}
+	onDisconnect := func() { states <- "disconnected" }
+
+	derpConn := newFakeConn()
+	b := newTestBind(t, derpConn, WithStateCallbacks(onConnect, onDisconnect))
+
+	waitState := func(want string) {
+		t.Helper()
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("state = %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %q callback", want)
+		}
+	}
+
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("first")}
+	receiveOne(t, b)
+	waitState("connected")
+	if !b.Connected() {
+		t.Error("Connected = false after a packet was received")
+	}
+
+	// The receive loop keeps going while onConnect is still running
+	derpConn.recv <- derp.ReceivedPacket{Source: testPeer, Data: []byte("second")}
+	if data, _ := receiveOne(t, b); string(data) != "second" {
+		t.Errorf("received %q, want %q", data, "second")
+	}
+	close(release)
+
+	// A failing Recv means the connection is lost
+	derpConn.Close()
+	waitState("disconnected")
+	if b.Connected() {
+		t.Error("Connected = true after the connection failed")
+	}
+}
@@ -0,0 +1,34 @@
+package wgbind
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// CheckDERPTLSConfig returns an error for a tls.Config that a DERP client
+// (derphttp.Client.TLSConfig) can't honor.
+//
+// derphttp verifies the server certificate itself, against the system roots
+// plus Let's Encrypt's, so RootCAs would be silently ignored and
+// InsecureSkipVerify or VerifyConnection make it panic. Client certificates
+// (Certificates, GetClientCertificate) and the other fields are used as is.
+//
+// To trust a DERP server with a private CA, add the CA to the system trust
+// store (or point SSL_CERT_FILE at a bundle including it), or pin the
+// server's certificate with CertName in a DERP map (see NewDERPClientFromMap).
+func CheckDERPTLSConfig(c *tls.Config) error {
+	if c == nil {
+		return nil
+	}
+	var errs []error
+	if c.RootCAs != nil {
+		errs = append(errs, errors.New("TLS config: RootCAs is not supported by the DERP client, install the CA in the system trust store instead"))
+	}
+	if c.InsecureSkipVerify {
+		errs = append(errs, errors.New("TLS config: InsecureSkipVerify is not supported by the DERP client"))
+	}
+	if c.VerifyConnection != nil {
+		errs = append(errs, errors.New("TLS config: VerifyConnection is not supported by the DERP client"))
+	}
+	return errors.Join(errs...)
+}